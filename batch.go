@@ -0,0 +1,114 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Batch is a function for grouping payloads into slices. A batch is emitted once it holds
+// size payloads or maxWait has passed since its first payload was received, a size or
+// maxWait <= 0 disables that limit, but not both. When the context is cancelled a partially filled batch
+// is sent to the flush function along with the payloads left in the channel. Like Transform
+// it cannot be used inside a loop.
+func Batch[T any](m Machine[T], size int, maxWait time.Duration) (Machine[[]T], error) {
+	x := m.(*builder[T])
+
+	if x.loop != nil {
+		return nil, fmt.Errorf("batch cannot be used in a loop")
+	} else if size <= 0 && maxWait <= 0 {
+		return nil, fmt.Errorf("batch size or max wait must be greater than 0")
+	}
+
+	name := x.name + ":batch"
+	n := x.attach("batch", name, map[string]string{
+		"size":     strconv.Itoa(size),
+		"max_wait": maxWait.String(),
+	})
+
+	this := child[T, []T](x, n, name, "", nil)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		b := &batcher[T]{size: size, maxWait: maxWait, output: this.output}
+		spawn(ctx, func() { b.run(ctx, name, channel, this.stage) })
+	}
+
+	return this, nil
+}
+
+// Unbatch is a function for splitting slices back into individual payloads, it is the
+// inverse of Batch. Like Transform it cannot be used inside a loop.
+func Unbatch[T any](m Machine[[]T]) (Machine[T], error) {
+	return expand(m, "unbatch", slices.Values[[]T])
+}
+
+type batcher[T any] struct {
+	size    int
+	maxWait time.Duration
+	output  chan []T
+}
+
+func (b *batcher[T]) run(ctx context.Context, path string, input chan T, option *config) {
+	option = option.untimed()
+	name := option.vertexName(path)
+	attrs := option.labels(path)
+	emit := vertex[[]T](func(ctx context.Context, data []T) {
+		send(ctx, b.output, data)
+	}).wrap(name, attrs, option)
+
+	d := drainFrom(ctx)
+	d.watch(func() int { return len(input) })
+	defer d.done()
+
+	var pending []T
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	release := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+
+		data := pending
+		pending = nil
+		emit(ctx, data)
+		d.add(-int64(len(data)))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+
+			if f := flusher[T](name, option); f != nil {
+				flush(name, input, pending, f, d)
+			}
+
+			d.add(-int64(len(pending)))
+			return
+		case <-expired:
+			release()
+		case data := <-input:
+			d.add(1)
+			d.drained(name)
+			pending = append(pending, data)
+
+			if b.size > 0 && len(pending) >= b.size {
+				release()
+			} else if timer == nil && b.maxWait > 0 {
+				timer = time.NewTimer(b.maxWait)
+				expired = timer.C
+			}
+		}
+	}
+}
@@ -7,6 +7,16 @@ package machine
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
+	"iter"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/whitaker-io/machine/common"
 )
 
 // Machine is the interface provided for creating a data processing stream.
@@ -46,6 +56,9 @@ type Machine[T any] interface {
 	//		 }
 	//	}
 	Memoize(x Monad[Monad[T]], index func(T) string) Machine[T]
+	// MemoizeShared is Memoize with the results cached across payloads in an LRU cache
+	// holding up to size results for the ttl.
+	MemoizeShared(x Monad[Monad[T]], index func(T) string, size int, ttl time.Duration) Machine[T]
 	// Or runs all of the functions until one succeeds or sends the payload to the right branch
 	Or(x ...Filter[T]) (Machine[T], Machine[T])
 	// And runs all of the functions and if one doesnt succeed sends the payload to the right branch
@@ -57,6 +70,13 @@ type Machine[T any] interface {
 	Select(fns ...Filter[T]) []Machine[T]
 	// Tee duplicates the data into multiple stream branches.
 	Tee(func(T) (a, b T)) (Machine[T], Machine[T])
+	// Broadcast duplicates the data into n stream branches, using clone to copy the payload
+	// for every branch after the first. Panics if n is less than 1.
+	Broadcast(n int, clone func(T) T) []Machine[T]
+	// BroadcastNamed duplicates the data into a stream branch for each of the names, using
+	// clone to copy the payload for every branch after the first. Panics if no names are
+	// provided or a name is repeated.
+	BroadcastNamed(clone func(T) T, names ...string) map[string]Machine[T]
 	// While creates a loop in the stream based on the filter
 	While(x Filter[T]) (loop, out Machine[T])
 	// Drop terminates the data from further processing without passing it on
@@ -65,9 +85,21 @@ type Machine[T any] interface {
 	Distribute(Edge[T]) Machine[T]
 	// Output provided channel
 	Output() chan T
+	// Named sets the name of the vertex that produced this Machine, the name is used for
+	// the metrics, spans, flush and dead letter functions in place of the generated path,
+	// which is kept as the "path" attribute.
+	Named(name string) Machine[T]
+	// With applies the options to the vertex that produced this Machine, overriding the
+	// settings provided to New for that stage only. Branches produced by the same vertex
+	// share its settings. OptionBufferSize resizes the channel feeding the vertex. The
+	// Machine returned by New is not produced by a vertex, pass its options to New instead,
+	// With and Named panic if they are used on it.
+	With(options ...Option) Machine[T]
+	// Describe returns the topology of the whole pipeline this Machine belongs to.
+	Describe() Graph
 
 	component(typeName string, fn func(output chan T) vertex[T]) Machine[T]
-	filterComponent(typeName string, fn filterComponent[T], loop bool) (Machine[T], Machine[T])
+	filterComponent(typeName string, fn filterComponent[T]) (Machine[T], Machine[T])
 	setup(ctx context.Context)
 	next(name string) *builder[T]
 }
@@ -75,63 +107,326 @@ type Machine[T any] interface {
 type builder[T any] struct {
 	name   string
 	option *config
+	stage  *config
 	output chan T
 	start  func(ctx context.Context, channel chan T)
-	loop   *builder[T]
+	loop   *loopback[T]
+	// buffer resizes the channel feeding the vertex that produced this builder
+	buffer func(size int)
+	// fixed is set when the output channel is owned by the caller or an Edge
+	fixed bool
+	graph *graph
+	port  *port
+	// flush is the type specific flush function set by OnFlush
+	flush *typedFlush[T]
+	// clock is the event time set by EventTime
+	clock *eventClock[T]
+	// timedOut is the branch set by OnTimeout
+	timedOut *builder[T]
+}
+
+// loopback is the entry of a loop, the branches inside the loop that are not
+// consumed feed back into it.
+type loopback[T any] struct {
+	start func(ctx context.Context, channel chan T)
+	port  *port
+}
+
+// timeoutSink sends the payloads given up on by OptionTimeout to the branch set by OnTimeout
+type timeoutSink[T any] func(ctx context.Context, data T)
+
+type partitioner[T any] struct {
+	key    func(d T) string
+	shards int
+}
+
+type typedFlush[T any] struct {
+	gracePeriod time.Duration
+	fn          func(ctx context.Context, payload T)
 }
 
 // New is a function for creating a new Machine.
 //
 // name string
 // input chan T
-// option *Option[T]
+// option ...Option
 //
-// Call the startFn returned by New to start the Machine once built.
+// Call the startFn returned by New to start the Machine once built. Use NewRunner
+// to be able to stop the Machine and wait for it to exit.
 func New[T any](name string, input chan T, options ...Option) (startFn func(context.Context), x Machine[T]) {
+	r, b := NewRunner(name, input, options...)
+
+	return func(ctx context.Context) {
+		_ = r.Start(ctx)
+	}, b
+}
+
+func root[T any](name string, input chan T, options ...Option) *builder[T] {
 	c := &config{}
 
 	for _, o := range options {
 		o.apply(c)
 	}
 
-	b := &builder[T]{
+	g := &graph{name: name}
+
+	return &builder[T]{
 		name:   name,
 		loop:   nil,
 		option: c,
+		stage:  c.clone(),
 		output: input,
+		fixed:  true,
+		graph:  g,
+		port:   g.port(g.node("input", name, nil, nil), "", name, nil),
 	}
-	return func(ctx context.Context) {
-		b.start(ctx, input)
-	}, b
 }
 
 // Transform is a function for converting the type of the Machine. Cannot be used inside a loop
-// until I figure out how to do it without some kind of run time error or overly complex
-// tracking method that isn't type safe. I really wish method level generics were a thing.
+// since the end of the loop has to feed back into the start, use WhileTransform to create a
+// loop that changes the type. I really wish method level generics were a thing.
 func Transform[T, U any](m Machine[T], fn func(d T) U) (Machine[U], error) {
 	x := m.(*builder[T])
 
 	if x.loop != nil {
-		return nil, fmt.Errorf("transform cannot be used in a loop")
+		return nil, fmt.Errorf("transform cannot be used in a loop, use WhileTransform")
 	}
 
-	this := &builder[U]{
-		name:   x.name + ":" + "transform",
-		loop:   nil,
-		option: x.option,
-		output: make(chan U, x.option.bufferSize),
+	name := x.name + ":" + "transform"
+	n := x.attach("transform", name, map[string]string{
+		"from": reflect.TypeFor[T]().String(),
+		"to":   reflect.TypeFor[U]().String(),
+	})
+
+	this := child[T, U](x, n, name, "", nil)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		vertex[T](func(ctx context.Context, payload T) {
+			send(ctx, this.output, fn(payload))
+		}).run(ctx, this.name, channel, this.stage)
+	}
+
+	return this, nil
+}
+
+// FlatMap is a function for splitting each payload into zero or more payloads of a new type.
+// Like Transform it cannot be used inside a loop.
+func FlatMap[T, U any](m Machine[T], fn func(d T) []U) (Machine[U], error) {
+	return expand(m, "flatmap", func(d T) iter.Seq[U] {
+		return slices.Values(fn(d))
+	})
+}
+
+// FlatMapSeq is a function for splitting each payload into the payloads yielded by the
+// iterator returned from fn. Like Transform it cannot be used inside a loop.
+func FlatMapSeq[T, U any](m Machine[T], fn func(d T) iter.Seq[U]) (Machine[U], error) {
+	return expand(m, "flatmap", fn)
+}
+
+func expand[T, U any](m Machine[T], typeName string, fn func(d T) iter.Seq[U]) (Machine[U], error) {
+	x := m.(*builder[T])
+
+	if x.loop != nil {
+		return nil, fmt.Errorf("%s cannot be used in a loop", typeName)
 	}
 
+	name := x.name + ":" + typeName
+	n := x.attach(typeName, name, map[string]string{
+		"from": reflect.TypeFor[T]().String(),
+		"to":   reflect.TypeFor[U]().String(),
+	})
+
+	this := child[T, U](x, n, name, "", nil)
+
 	x.start = func(ctx context.Context, channel chan T) {
 		this.setup(ctx)
-		vertex[T](func(_ context.Context, payload T) {
-			this.output <- fn(payload)
-		}).run(ctx, this.name, channel, x.option)
+		vertex[T](func(ctx context.Context, payload T) {
+			for d := range fn(payload) {
+				send(ctx, this.output, d)
+			}
+		}).run(ctx, this.name, channel, this.stage)
 	}
 
 	return this, nil
 }
 
+// WhileTransform creates a loop in the stream based on the filter, where the loop branch is
+// of a different type. Payloads matching the filter are converted by forward and sent to the
+// loop branch, the end of the loop branch is converted back by feedback and sent to the filter.
+func WhileTransform[T, U any](
+	m Machine[T],
+	fn Filter[T],
+	forward func(d T) U,
+	feedback func(d U) T,
+) (loop Machine[U], out Machine[T]) {
+	x := m.(*builder[T])
+
+	name := x.name + ":" + "while-transform"
+	n := x.attach("while-transform", name, map[string]string{
+		"from": reflect.TypeFor[T]().String(),
+		"to":   reflect.TypeFor[U]().String(),
+	})
+
+	it := &iterations[T]{}
+
+	back := &loopback[U]{
+		start: func(ctx context.Context, channel chan U) {
+			spawn(ctx, func() {
+				transfer(ctx, channel,
+					func(ctx context.Context, data U) {
+						send(ctx, x.output, feedback(data))
+					},
+					name,
+					x.option,
+				)
+			})
+		},
+		port: x.port,
+	}
+
+	left := child[T, U](x, n, name+":left", "left", back)
+	right := child(x, n, x.name+":right", "right", x.loop)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+
+		vertex[T](func(ctx context.Context, data T) {
+			if fn(data) {
+				it.next(n.stage, data)
+				send(ctx, left.output, forward(data))
+			} else {
+				it.done(n.stage, data)
+				send(ctx, right.output, data)
+			}
+		}).run(ctx, name, channel, n.stage)
+	}
+
+	return left, right
+}
+
+// Try applies a function that can fail to the payload. Successful results are sent to the ok
+// branch and failures are wrapped in a Failure and sent to the failed branch. The failed branch
+// is never part of a loop, since it is not the same type as the loop.
+func Try[T any](m Machine[T], fn func(d T) (T, error)) (ok Machine[T], failed Machine[Failure[T]]) {
+	x := m.(*builder[T])
+
+	name := x.name + ":" + "try"
+	n := x.attach("try", name, nil)
+	stage := n.stage
+
+	left := child(x, n, name+":ok", "ok", x.loop)
+	right := child[T, Failure[T]](x, n, name+":failed", "failed", nil)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+		vertex[T](func(ctx context.Context, payload T) {
+			if out, err := fn(payload); err != nil {
+				send(ctx, right.output, Failure[T]{Vertex: stage.vertexName(name), Payload: payload, Err: err})
+			} else {
+				send(ctx, left.output, out)
+			}
+		}).run(ctx, name, channel, stage)
+	}
+
+	return left, right
+}
+
+// Merge is a function for joining branches of a Machine back into a single stream. The
+// result is part of a loop only if every branch is part of the same loop.
+func Merge[T any](m Machine[T], ms ...Machine[T]) Machine[T] {
+	inputs := []*builder[T]{m.(*builder[T])}
+	for _, x := range ms {
+		inputs = append(inputs, x.(*builder[T]))
+	}
+
+	x := inputs[0]
+	loop := x.loop
+	for _, in := range inputs[1:] {
+		if in.loop != loop {
+			loop = nil
+		}
+	}
+
+	for _, in := range inputs[1:] {
+		x.graph.merge(in.graph)
+	}
+
+	name := x.name + ":" + "merge"
+	n := x.attach("merge", name, nil)
+	stage := n.stage
+
+	this := child(x, n, name, "", loop)
+	this.buffer = func(size int) {
+		for _, in := range inputs {
+			in.resize(size)
+		}
+	}
+
+	once := &sync.Once{}
+	for _, in := range inputs {
+		in.port.to = n
+		in.start = func(ctx context.Context, channel chan T) {
+			once.Do(func() { this.setup(ctx) })
+			vertex[T](func(ctx context.Context, payload T) {
+				send(ctx, this.output, payload)
+			}).run(ctx, name, channel, stage)
+		}
+	}
+
+	return this
+}
+
+// Partition runs the stages built from m afterwards, until the type of the Machine is
+// changed, with shards FIFO lanes per vertex. Payloads are assigned to a lane by the hash
+// of their key, so payloads with the same key are processed in order while payloads with
+// different keys are processed concurrently. It takes precedence over OptionFIF0,
+// OptionOrdered and OptionConcurrency.
+func Partition[T any](m Machine[T], key func(d T) string, shards int) Machine[T] {
+	x := m.(*builder[T])
+	x.option = x.option.clone()
+	x.option.partition = &partitioner[T]{key: key, shards: max(shards, 1)}
+	return x
+}
+
+// OnFlush sets a type specific flush function for the payloads left in the channels of m, and
+// of the stages built from m afterwards, when the context is cancelled. The function takes
+// precedence over OptionFlush until the type of the Machine is changed. The context passed
+// to fn is cancelled once the gracePeriod has expired.
+func OnFlush[T any](m Machine[T], gracePeriod time.Duration, fn func(ctx context.Context, payload T)) Machine[T] {
+	x := m.(*builder[T])
+	x.flush = &typedFlush[T]{gracePeriod: gracePeriod, fn: fn}
+	return x
+}
+
+// OnTimeout returns a timedOut branch for the payloads that miss the deadline set by
+// OptionTimeout in the stages built from out, until the type of the Machine is changed.
+// Payloads sent to the timedOut branch are not passed to the OptionDeadLetter function.
+// The timedOut branch is never part of a loop.
+func OnTimeout[T any](m Machine[T]) (out, timedOut Machine[T]) {
+	x := m.(*builder[T])
+
+	name := x.name + ":" + "on-timeout"
+	n := x.attach("on-timeout", name, nil)
+
+	left := child(x, n, name, "", x.loop)
+	right := child[T, T](x, n, name+":timeout", "timeout", nil)
+	left.timedOut = right
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+
+		vertex[T](func(ctx context.Context, payload T) {
+			send(ctx, left.output, payload)
+		}).run(ctx, name, channel, n.stage.untimed())
+	}
+
+	return left, right
+}
+
 // Name returns the name of the Machine path. Useful for debugging or reasoning about the path.
 func (x *builder[T]) Name() string {
 	return x.name
@@ -149,7 +444,7 @@ func (x *builder[T]) Select(fns ...Filter[T]) []Machine[T] {
 
 	var last = x
 	for i, fn := range fns {
-		o, l := last.filterComponent(fmt.Sprintf("select-%d", i), fn.component, false)
+		o, l := last.filterComponent(fmt.Sprintf("select-%d", i), fn.component)
 		out = append(out, o)
 		last = l.(*builder[T])
 	}
@@ -161,58 +456,136 @@ func (x *builder[T]) Select(fns ...Filter[T]) []Machine[T] {
 
 // Recurse applies a recursive function to the payload through a Y Combinator.
 func (x *builder[T]) Recurse(fn Monad[Monad[T]]) Machine[T] {
-	g := func(h recursiveBaseFn[T]) Monad[T] {
-		return func(payload T) T {
-			return fn(h(h))(payload)
-		}
+	this := x.next("recurse")
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		vertex[T](func(ctx context.Context, payload T) {
+			depth := limit(this.stage.maxDepth, ErrMaxDepth)
+			g := func(h recursiveBaseFn[T]) Monad[T] {
+				return func(payload T) T {
+					defer depth()()
+					return fn(h(h))(payload)
+				}
+			}
+
+			send(ctx, this.output, g(g)(payload))
+		}).run(ctx, this.name, channel, this.stage)
 	}
-	p := g(g)
 
-	return x.component("recurse", p.component)
+	return this
 }
 
 // Memoize applies a recursive function to the payload through a Y Combinator
 // and memoizes the results based on the index func.
 func (x *builder[T]) Memoize(fn Monad[Monad[T]], index func(T) string) Machine[T] {
-	g := func(h memoizedBaseFn[T], m map[string]T) Monad[T] {
-		return func(payload T) T {
-			id := index(payload)
-			if v, ok := m[id]; ok {
+	this := x.next("memoize")
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		vertex[T](func(ctx context.Context, payload T) {
+			depth := limit(this.stage.maxDepth, ErrMaxDepth)
+			g := func(h memoizedBaseFn[T], m map[string]T) Monad[T] {
+				return func(payload T) T {
+					id := index(payload)
+					if v, ok := m[id]; ok {
+						return v
+					}
+
+					defer depth()()
+					m[id] = fn(h(h, m))(payload)
+					return m[id]
+				}
+			}
+
+			send(ctx, this.output, g(g, map[string]T{})(payload))
+		}).run(ctx, this.name, channel, this.stage)
+	}
+
+	return this
+}
+
+// MemoizeShared applies a recursive function to the payload through a Y Combinator and
+// memoizes the results based on the index func like Memoize, except the results are kept
+// in an LRU cache shared by every payload. The cache holds up to size results, or is
+// unbounded if size <= 0, and results expire after the ttl if it is > 0. Cached results are
+// returned to every payload with the same index, so they should not be modified. The cache
+// hits and misses are recorded as the machine.cache.hits and machine.cache.misses metrics.
+func (x *builder[T]) MemoizeShared(fn Monad[Monad[T]], index func(T) string, size int, ttl time.Duration) Machine[T] {
+	cache := newLRU[T](size, ttl)
+	this := x.next("memoize")
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		attrs := this.stage.labels(this.name)
+
+		vertex[T](func(ctx context.Context, payload T) {
+			var hits, misses int64
+			var memo Monad[T]
+			depth := limit(this.stage.maxDepth, ErrMaxDepth)
+			memo = func(payload T) T {
+				id := index(payload)
+				if v, ok := cache.get(id); ok {
+					hits++
+					return v
+				}
+
+				misses++
+				defer depth()()
+				v := fn(memo)(payload)
+				cache.put(id, v)
 				return v
 			}
 
-			m[id] = fn(h(h, m))(payload)
-			return m[id]
-		}
+			out := memo(payload)
+
+			slog.LogAttrs(
+				ctx,
+				common.LevelMetric,
+				"machine.cache.hits",
+				attrs.with(
+					slog.String("type", common.MetricInt64Counter),
+					slog.Int64("value", hits),
+				)...,
+			)
+			slog.LogAttrs(
+				ctx,
+				common.LevelMetric,
+				"machine.cache.misses",
+				attrs.with(
+					slog.String("type", common.MetricInt64Counter),
+					slog.Int64("value", misses),
+				)...,
+			)
+
+			send(ctx, this.output, out)
+		}).run(ctx, this.name, channel, this.stage)
 	}
-	p := Monad[T](func(payload T) T {
-		m := map[string]T{}
-		return g(g, m)(payload)
-	})
 
-	return x.component("memoize", p.component)
+	return this
 }
 
 // Drop terminates the data from further processing without passing it on
 func (x *builder[T]) Drop() {
+	x.attach("drop", x.name+":drop", nil)
 	x.start = func(ctx context.Context, input chan T) {
-		go transfer(ctx, input, func(_ context.Context, _ T) {}, "", &config{})
+		spawn(ctx, func() { transfer(ctx, input, func(_ context.Context, _ T) {}, "", &config{}) })
 	}
 }
 
 // Or runs all of the functions until one succeeds or sends the payload to the right branch
 func (x *builder[T]) Or(list ...Filter[T]) (left, right Machine[T]) {
-	return x.filterComponent("or", filterList[T](list).or().component, false)
+	return x.filterComponent("or", filterList[T](list).or().component)
 }
 
 // And runs all of the functions and if one doesnt succeed sends the payload to the right branch
 func (x *builder[T]) And(list ...Filter[T]) (left, right Machine[T]) {
-	return x.filterComponent("and", filterList[T](list).and().component, false)
+	return x.filterComponent("and", filterList[T](list).and().component)
 }
 
 // If splits the data into multiple stream branches
 func (x *builder[T]) If(fn Filter[T]) (left, right Machine[T]) {
-	return x.filterComponent("if", fn.component, false)
+	return x.filterComponent("if", fn.component)
 }
 
 // Tee duplicates the data into multiple stream branches. The payload/vertexes are
@@ -220,30 +593,156 @@ func (x *builder[T]) If(fn Filter[T]) (left, right Machine[T]) {
 func (x *builder[T]) Tee(fn func(T) (a, b T)) (left, right Machine[T]) {
 	return x.filterComponent("tee",
 		func(left, right chan T) vertex[T] {
-			return func(_ context.Context, payload T) {
+			return func(ctx context.Context, payload T) {
 				a, b := fn(payload)
-				left <- a
-				right <- b
+				send(ctx, left, a)
+				send(ctx, right, b)
 			}
 		},
-		false,
 	)
 }
 
+// Broadcast duplicates the data into n stream branches. The payload is sent to the first
+// branch and clone is used to copy it for every other branch, so that the branches can
+// modify their payload concurrently. If clone is nil the branches share the payload.
+// Panics if n is less than 1.
+func (x *builder[T]) Broadcast(n int, clone func(T) T) []Machine[T] {
+	if n < 1 {
+		panic(fmt.Sprintf("machine: broadcast of %s needs at least 1 branch, got %d", x.name, n))
+	}
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+
+	out := []Machine[T]{}
+	for _, b := range x.broadcast(clone, names) {
+		out = append(out, b)
+	}
+
+	return out
+}
+
+// BroadcastNamed duplicates the data into a stream branch for each of the names, which
+// must be unique, a repeated name would leave a branch that cannot be read. The payload
+// is sent to the first branch and clone is used to copy it for every other branch. If
+// clone is nil the branches share the payload.
+func (x *builder[T]) BroadcastNamed(clone func(T) T, names ...string) map[string]Machine[T] {
+	if len(names) == 0 {
+		panic(fmt.Sprintf("machine: broadcast of %s needs at least 1 name", x.name))
+	}
+
+	out := map[string]Machine[T]{}
+	for _, name := range names {
+		if _, ok := out[name]; ok {
+			panic(fmt.Sprintf("machine: broadcast of %s has the name %q more than once", x.name, name))
+		}
+		out[name] = nil
+	}
+
+	for i, b := range x.broadcast(clone, names) {
+		out[names[i]] = b
+	}
+
+	return out
+}
+
+func (x *builder[T]) broadcast(clone func(T) T, names []string) []*builder[T] {
+	name := x.name + ":" + "broadcast"
+	n := x.attach("broadcast", name, nil)
+
+	branches := make([]*builder[T], len(names))
+	for i, b := range names {
+		branches[i] = child(x, n, name+":"+b, b, x.loop)
+	}
+
+	x.start = func(ctx context.Context, channel chan T) {
+		for _, b := range branches {
+			b.setup(ctx)
+		}
+
+		vertex[T](func(ctx context.Context, payload T) {
+			// copy the payload for every branch before any branch can modify it
+			copies := make([]T, len(branches))
+			for i := range copies {
+				if i == 0 || clone == nil {
+					copies[i] = payload
+				} else {
+					copies[i] = clone(payload)
+				}
+			}
+
+			for i, b := range branches {
+				send(ctx, b.output, copies[i])
+			}
+		}).run(ctx, name, channel, n.stage)
+	}
+
+	return branches
+}
+
 // While creates a loop in the stream based on the filter
 func (x *builder[T]) While(fn Filter[T]) (loop, out Machine[T]) {
-	return x.filterComponent("while", fn.component, true)
+	name := x.name + ":" + "while"
+	n := x.attach("while", name, nil)
+	it := &iterations[T]{}
+
+	back := &loopback[T]{
+		start: func(ctx context.Context, channel chan T) {
+			spawn(ctx, func() {
+				transfer(ctx, channel,
+					func(ctx context.Context, data T) {
+						send(ctx, x.output, data)
+					},
+					name,
+					x.option,
+				)
+			})
+		},
+		port: x.port,
+	}
+
+	left := child(x, n, name+":left", "left", back)
+	right := child(x, n, x.name+":right", "right", x.loop)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+
+		vertex[T](func(ctx context.Context, payload T) {
+			if fn(payload) {
+				it.next(n.stage, payload)
+				send(ctx, left.output, payload)
+			} else {
+				it.done(n.stage, payload)
+				send(ctx, right.output, payload)
+			}
+		}).run(ctx, name, channel, n.stage)
+	}
+
+	return left, right
 }
 
 // Distribute is a function used for fanout
 func (x *builder[T]) Distribute(edge Edge[T]) Machine[T] {
 	this := x.next("distribute")
 
+	this.port.label = "edge"
 	this.output = edge.Output()
+	this.fixed = true
 	x.start = func(ctx context.Context, channel chan T) {
 		this.setup(ctx)
 
-		vertex[T](edge.Send).run(ctx, this.name, channel, x.option)
+		vertex[T](func(ctx context.Context, payload T) {
+			await(ctx)
+
+			// once Edge.Send is called the payload is the responsibility of the Edge
+			if d := deadlineFrom(ctx); d.claim() {
+				edge.Send(ctx, payload)
+				d.sent()
+			}
+		}).run(ctx, this.name, channel, this.stage)
 	}
 
 	return this
@@ -254,57 +753,60 @@ func (x *builder[T]) Output() chan T {
 	return x.output
 }
 
+// Named sets the name of the vertex that produced this Machine, the name is used for
+// the metrics, spans, flush and dead letter functions in place of the generated path.
+func (x *builder[T]) Named(name string) Machine[T] {
+	return x.With(&option{func(c *config) { c.name = name }})
+}
+
+// With applies the options to the vertex that produced this Machine, overriding the
+// settings provided to New for that stage only. OptionBufferSize resizes the channel
+// feeding the vertex, unless that channel was provided to New or by an Edge. The Machine
+// returned by New has no vertex to apply the options to, so With panics if used on it.
+func (x *builder[T]) With(options ...Option) Machine[T] {
+	if x.port.from.typeName == "input" {
+		panic(fmt.Sprintf("machine: With cannot be used on the input of %s, pass the options to New", x.name))
+	}
+
+	for _, o := range options {
+		o.apply(x.stage)
+	}
+
+	if x.buffer != nil && x.stage.bufferSize != x.option.bufferSize {
+		x.buffer(x.stage.bufferSize)
+	}
+
+	return x
+}
+
+// Describe returns the topology of the whole pipeline this Machine belongs to.
+func (x *builder[T]) Describe() Graph {
+	return x.graph.describe()
+}
+
 func (x *builder[T]) component(typeName string, fn func(output chan T) vertex[T]) Machine[T] {
 	this := x.next(typeName)
 
 	x.start = func(ctx context.Context, channel chan T) {
 		this.setup(ctx)
-		fn(this.output).run(ctx, this.name, channel, x.option)
+		fn(this.output).run(ctx, this.name, channel, this.stage)
 	}
 
 	return this
 }
 
-func (x *builder[T]) filterComponent(typeName string, fn filterComponent[T], loop bool) (Machine[T], Machine[T]) {
+func (x *builder[T]) filterComponent(typeName string, fn filterComponent[T]) (Machine[T], Machine[T]) {
 	name := x.name + ":" + typeName
+	n := x.attach(typeName, name, nil)
 
-	l := x.loop
-
-	if loop {
-		l = x
-	}
-
-	left := &builder[T]{
-		name:   name + ":left",
-		loop:   l,
-		option: x.option,
-		output: make(chan T, x.option.bufferSize),
-	}
-
-	right := x.next("right")
-
-	alreadySetup := false
+	left := child(x, n, name+":left", "left", x.loop)
+	right := child(x, n, x.name+":right", "right", x.loop)
 
 	x.start = func(ctx context.Context, channel chan T) {
-		if alreadySetup {
-			if typeName == "while" {
-				go transfer(ctx, channel,
-					func(_ context.Context, data T) {
-						x.output <- data
-					},
-					name,
-					x.option,
-				)
-			}
-			return
-		}
-
-		alreadySetup = true
-
 		left.setup(ctx)
 		right.setup(ctx)
 
-		fn(left.output, right.output).run(ctx, name, channel, x.option)
+		fn(left.output, right.output).run(ctx, name, channel, left.stage)
 	}
 
 	return left, right
@@ -321,37 +823,210 @@ func (x *builder[T]) setup(ctx context.Context) {
 }
 
 func (x *builder[T]) next(name string) *builder[T] {
-	return &builder[T]{
-		name:   x.name + ":" + name,
-		loop:   x.loop,
-		option: x.option,
-		output: make(chan T, x.option.bufferSize),
+	path := x.name + ":" + name
+	return child(x, x.attach(name, path, nil), path, "", x.loop)
+}
+
+// attach records a vertex of the typeName consuming the output of this builder
+func (x *builder[T]) attach(typeName, path string, options map[string]string) *node {
+	stage := x.option.clone()
+	if x.flush != nil {
+		stage.typedFlush = x.flush
+	}
+	if t := x.timedOut; t != nil {
+		stage.timedOut = timeoutSink[T](func(ctx context.Context, data T) {
+			send(ctx, t.output, data)
+		})
+	}
+
+	n := x.graph.node(typeName, path, stage, options)
+	x.port.to = n
+	return n
+}
+
+// child creates a builder for an output of the vertex n, which consumes the output of x
+func child[T, U any](x *builder[T], n *node, name, label string, loop *loopback[U]) *builder[U] {
+	var lp *port
+	if loop != nil {
+		lp = loop.port
+	}
+
+	// the typed flush function and event time are inherited until the type changes
+	f, _ := any(x.flush).(*typedFlush[U])
+	c, _ := any(x.clock).(*eventClock[U])
+	t, _ := any(x.timedOut).(*builder[U])
+
+	return &builder[U]{
+		name:     name,
+		loop:     loop,
+		option:   x.option,
+		stage:    n.stage,
+		output:   make(chan U, x.option.bufferSize),
+		buffer:   x.resize,
+		graph:    x.graph,
+		port:     x.graph.port(n, label, name, lp),
+		flush:    f,
+		clock:    c,
+		timedOut: t,
+	}
+}
+
+func (x *builder[T]) resize(size int) {
+	if !x.fixed {
+		x.output = make(chan T, size)
 	}
 }
 
 func transfer[T any](ctx context.Context, input chan T, fn vertex[T], vertexName string, option *config) {
+	d := drainFrom(ctx)
+	d.watch(func() int { return len(input) })
+	defer d.done()
+
 	for {
 		select {
 		case <-ctx.Done():
-			if option.flushFN != nil && option.gracePeriod > 0 {
-				flush(vertexName, input, option)
+			if f := flusher[T](vertexName, option); f != nil {
+				flush(vertexName, input, nil, f, d)
 			}
 			return
 		case data := <-input:
+			d.add(1)
+			d.drained(vertexName)
 			fn(ctx, data)
+			d.add(-1)
 		}
 	}
 }
 
-func flush[T any](vertexName string, input chan T, option *config) {
-	c, cancel := context.WithTimeout(context.Background(), option.gracePeriod)
+// flusher returns the flush function of the vertex, the typed flush function takes
+// precedence over OptionFlush. It returns nil if flushing is not enabled.
+func flusher[T any](vertexName string, option *config) *typedFlush[T] {
+	if f, ok := option.typedFlush.(*typedFlush[T]); ok && f.gracePeriod > 0 {
+		return f
+	} else if option.flushFN != nil && option.gracePeriod > 0 {
+		return &typedFlush[T]{
+			gracePeriod: option.gracePeriod,
+			fn:          func(_ context.Context, payload T) { option.flushFN(vertexName, payload) },
+		}
+	}
+
+	return nil
+}
+
+// flush sends the pending payloads held by the vertex followed by the payloads
+// left in the input to the flush function until the grace period expires.
+func flush[T any](vertexName string, input chan T, pending []T, f *typedFlush[T], d *drain) {
+	c, cancel := context.WithTimeout(context.Background(), f.gracePeriod)
 	defer cancel()
+
+	for _, data := range pending {
+		if c.Err() != nil {
+			return
+		}
+		d.flushed(vertexName)
+		f.fn(c, data)
+	}
+
+	if input == nil {
+		return
+	}
+
 	for {
 		select {
 		case <-c.Done():
 			return
 		case data := <-input:
-			option.flushFN(vertexName, data)
+			d.flushed(vertexName)
+			f.fn(c, data)
 		}
 	}
 }
+
+// limit returns a function that counts a call towards n, it panics with err once n is
+// exceeded and returns the function to call once the call has returned.
+func limit(n int, err error) func() func() {
+	count := 0
+	return func() func() {
+		if count++; n > 0 && count > n {
+			panic(err)
+		}
+		return func() { count-- }
+	}
+}
+
+// iterations counts the number of times each payload inside a loop has gone around it, the
+// payloads are told apart by the key set through OptionMaxIterations. A payload that is dropped
+// inside the loop keeps its count until a payload with the same key leaves through the filter.
+type iterations[T any] struct {
+	m      sync.Mutex
+	counts map[string]int
+}
+
+// next records a payload going around the loop, it panics with ErrMaxIterations once the
+// payload has gone around more than the limit.
+func (it *iterations[T]) next(option *config, data T) {
+	key, ok := it.key(option)
+	if !ok {
+		return
+	}
+
+	k := key(data)
+
+	it.m.Lock()
+	defer it.m.Unlock()
+
+	if it.counts == nil {
+		it.counts = map[string]int{}
+	}
+
+	if it.counts[k]++; it.counts[k] > option.maxIter {
+		delete(it.counts, k)
+		panic(ErrMaxIterations)
+	}
+}
+
+// done records a payload leaving the loop through the filter
+func (it *iterations[T]) done(option *config, data T) {
+	key, ok := it.key(option)
+	if !ok {
+		return
+	}
+
+	k := key(data)
+
+	it.m.Lock()
+	defer it.m.Unlock()
+
+	delete(it.counts, k)
+}
+
+func (it *iterations[T]) key(option *config) (func(d T) string, bool) {
+	key, ok := option.iterKey.(func(d T) string)
+	return key, ok && key != nil && option.maxIter > 0
+}
+
+func (f *typedFlush[T]) period() time.Duration {
+	return f.gracePeriod
+}
+
+// shard returns the lane of the payload
+func (p *partitioner[T]) shard(data T) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(p.key(data)))
+	return int(h.Sum32() % uint32(p.shards))
+}
+
+// tryShard returns the lane of the payload, or false if the key function panicked
+func (p *partitioner[T]) tryShard(data T) (i int, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	return p.shard(data), true
+}
+
+func (p *partitioner[T]) size() int {
+	return p.shards
+}
@@ -7,9 +7,14 @@ package machine
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -546,3 +551,1254 @@ func Test_Loop(b *testing.T) {
 
 	<-time.After(100 * time.Millisecond)
 }
+
+func Test_Try(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{
+				name:  fmt.Sprintf("name%d", n),
+				value: n,
+			}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	ok, failed := Try(m, func(d *kv) (*kv, error) {
+		if d.value%2 == 0 {
+			return nil, fmt.Errorf("even value %d", d.value)
+		}
+		return d, nil
+	})
+
+	outGood := ok.Output()
+	outFailed := failed.Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		select {
+		case d := <-outGood:
+			if d.value%2 == 0 {
+				b.Errorf("unexpected value %v", d.value)
+			}
+		case f := <-outFailed:
+			if f.Payload.value%2 != 0 || f.Err == nil || f.Vertex != "machine_id:try" {
+				b.Errorf("unexpected failure %v", f)
+			}
+		}
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+type panicEdge[T any] chan T
+
+func (t panicEdge[T]) Output() chan T {
+	return t
+}
+func (t panicEdge[T]) Send(_ context.Context, _ T) {
+	panic("edge failure")
+}
+
+func Test_DeadLetter(b *testing.T) {
+	count := 100
+	channel := make(chan *kv)
+	letters := make(chan error)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{
+				name:  fmt.Sprintf("name%d", n),
+				value: n,
+			}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			if _, ok := payload.(*kv); !ok {
+				b.Errorf("unexpected payload %v", payload)
+			}
+			letters <- err
+		}),
+	)
+
+	left, right := m.If(func(d *kv) bool {
+		return d.value%2 == 0
+	})
+
+	left.Then(
+		func(m *kv) *kv {
+			panic(fmt.Errorf("error"))
+		},
+	)
+	right.Distribute(panicEdge[*kv](make(chan *kv)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		err := <-letters
+		p, ok := err.(*PanicError)
+		if !ok || p.Value == nil || len(p.Stack) == 0 || p.PayloadType != "*machine.kv" {
+			b.Errorf("unexpected dead letter error %v", err)
+			b.FailNow()
+		}
+
+		switch p.Vertex {
+		case "machine_id:if:left:then":
+			if p.Unwrap() == nil {
+				b.Errorf("expected wrapped error %v", p)
+			}
+		case "machine_id:right:distribute":
+			if p.Value != "edge failure" || p.Unwrap() != nil {
+				b.Errorf("expected non-error panic value %v", p)
+			}
+		default:
+			b.Errorf("unexpected vertex %s", p.Vertex)
+		}
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_Concurrency(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+		OptionConcurrency(4),
+	)
+
+	limit := func(n int64) Monad[*kv] {
+		active := &atomic.Int64{}
+		return func(d *kv) *kv {
+			if active.Add(1) > n {
+				b.Errorf("more than %d workers running", n)
+			}
+			<-time.After(time.Microsecond)
+			active.Add(-1)
+			return d
+		}
+	}
+
+	out := m.
+		Then(limit(4)).
+		Then(limit(1)).With(OptionConcurrency(1)).
+		Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		<-out
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_Ordered(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{
+				name:  fmt.Sprintf("name%d", n),
+				value: n,
+			}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+		OptionOrdered(8),
+	)
+
+	out := m.
+		Then(
+			func(d *kv) *kv {
+				<-time.After(time.Duration(count-d.value%7) * time.Microsecond)
+				return d
+			},
+		).
+		Distribute(channelEdge[*kv](make(chan *kv))).
+		Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		if d := <-out; d.value != n {
+			b.Errorf("expected %d got %d", n, d.value)
+			b.FailNow()
+		}
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_With(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{
+				name:  fmt.Sprintf("name%d", n),
+				value: n,
+			}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	then := m.Then(
+		func(d *kv) *kv {
+			return d
+		},
+	).With(OptionFIF0)
+
+	out := then.
+		Distribute(channelEdge[*kv](make(chan *kv))).
+		With(OptionBufferSize(100), OptionFIF0)
+
+	if size := cap(then.Output()); size != 100 {
+		b.Errorf("expected buffer of 100 got %d", size)
+	}
+
+	if x := m.(*builder[*kv]); x.option.fifo || x.option.bufferSize != 0 {
+		b.Errorf("stage options leaked into the pipeline options")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				b.Errorf("expected With on the input to panic")
+			}
+		}()
+		m.With(OptionFIF0)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		if d := <-out.Output(); d.value != n {
+			b.Errorf("expected %d got %d", n, d.value)
+			b.FailNow()
+		}
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_Named(b *testing.T) {
+	channel := make(chan *kv)
+	letters := make(chan string)
+
+	startFn, m := New("machine_id",
+		channel,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			letters <- vertexName
+		}),
+	)
+
+	ok, failed := Try(
+		m.Then(
+			func(d *kv) *kv {
+				if d.value < 0 {
+					panic("negative value")
+				}
+				return d
+			},
+		).Named("enrich-user"),
+		func(d *kv) (*kv, error) {
+			return d, fmt.Errorf("error")
+		},
+	)
+	ok = ok.Named("validate")
+
+	if ok.Name() != "machine_id:then:try:ok" {
+		b.Errorf("unexpected path %s", ok.Name())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	channel <- &kv{name: "negative", value: -1}
+	if name := <-letters; name != "enrich-user" {
+		b.Errorf("unexpected vertex name %s", name)
+	}
+
+	channel <- &kv{name: "positive", value: 1}
+	if f := <-failed.Output(); f.Vertex != "validate" {
+		b.Errorf("unexpected vertex name %s", f.Vertex)
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_OnFlush(b *testing.T) {
+	count := 100
+	channel := make(chan *kv)
+	flushed := &atomic.Int64{}
+	startFn, m := New("machine_id",
+		channel,
+		OptionFIF0,
+		OptionBufferSize(count),
+		OptionFlush(time.Second, func(_ string, payload any) {
+			b.Errorf("untyped flush should not be called %v", payload)
+		}),
+	)
+
+	x, _ := Transform(
+		OnFlush(m, 100*time.Millisecond, func(_ context.Context, payload *kv) {
+			flushed.Add(1)
+		}).Then(
+			func(d *kv) *kv {
+				return d
+			},
+		).Then(
+			func(d *kv) *kv {
+				<-time.After(10 * time.Millisecond)
+				return d
+			},
+		),
+		func(d *kv) int {
+			return d.value
+		},
+	)
+
+	OnFlush(x, 100*time.Millisecond, func(_ context.Context, payload int) {
+		flushed.Add(1)
+	}).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		channel <- deepcopy(testPayloadBase)
+	}
+
+	cancel()
+
+	<-time.After(200 * time.Millisecond)
+
+	if flushed.Load() == 0 {
+		b.Errorf("expected payloads to be flushed")
+	}
+}
+
+func Test_WhileTransform(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{
+				name:  fmt.Sprintf("name%d", n),
+				value: n % 10,
+			}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	loop, out := WhileTransform(m,
+		func(d *kv) bool {
+			return d.value < 10
+		},
+		func(d *kv) int {
+			return d.value
+		},
+		func(d int) *kv {
+			return &kv{name: "looped", value: d}
+		},
+	)
+
+	loop.Then(
+		func(d int) int {
+			return d + 1
+		},
+	)
+
+	if _, err := Transform(loop, strconv.Itoa); err == nil {
+		b.Errorf("expected error for Transform inside of a loop")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		if d := <-out.Output(); d.value != 10 {
+			b.Errorf("unexpected value %v", d.value)
+		}
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_FlatMap(b *testing.T) {
+	count := 1000
+	channel := make(chan []*kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- []*kv{deepcopy(testPayloadBase), deepcopy(testPayloadBase)}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	x, err := FlatMap(m, func(d []*kv) []*kv {
+		return d
+	})
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	y, err := FlatMapSeq(x, func(d *kv) iter.Seq[int] {
+		return func(yield func(int) bool) {
+			for i := 0; i < d.value; i++ {
+				if !yield(i) {
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	_, m2 := New("machine_id", make(chan []*kv))
+	loop, _ := m2.While(func(d []*kv) bool {
+		return false
+	})
+
+	if _, err := FlatMap(loop, func(d []*kv) []*kv {
+		return d
+	}); err == nil {
+		b.Errorf("expected error for FlatMap inside of a loop")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	startFn(ctx)
+
+	for n := 0; n < 2*count*testPayloadBase.value; n++ {
+		<-y.Output()
+	}
+
+	cancel()
+
+	<-time.After(10 * time.Millisecond)
+}
+
+func Test_Batch(b *testing.T) {
+	count := 10
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	x, err := Batch(m, 4, 50*time.Millisecond)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	y, err := Unbatch(x.Then(func(d []*kv) []*kv {
+		if len(d) > 4 {
+			b.Errorf("expected at most 4 payloads in a batch %v", len(d))
+		}
+		return d
+	}))
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	_, m2 := New("machine_id", make(chan *kv))
+	loop, _ := m2.While(func(d *kv) bool {
+		return false
+	})
+
+	if _, err := Batch(loop, 4, 0); err == nil {
+		b.Errorf("expected error for Batch inside of a loop")
+	}
+
+	_, m3 := New("machine_id", make(chan *kv))
+	if _, err := Batch(m3, 0, 0); err == nil {
+		b.Errorf("expected error for Batch without a size or max wait")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+	}()
+
+	for n := 0; n < count; n++ {
+		select {
+		case <-y.Output():
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+}
+
+func Test_Batch_Flush(b *testing.T) {
+	channel := make(chan *kv)
+	flushed := &atomic.Int64{}
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	x, _ := Batch(
+		OnFlush(m, 100*time.Millisecond, func(_ context.Context, payload *kv) {
+			flushed.Add(1)
+		}),
+		10,
+		0,
+	)
+
+	x.Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startFn(ctx)
+
+	for n := 0; n < 5; n++ {
+		channel <- deepcopy(testPayloadBase)
+	}
+
+	<-time.After(10 * time.Millisecond)
+	cancel()
+	<-time.After(50 * time.Millisecond)
+
+	if flushed.Load() != 5 {
+		b.Errorf("expected partial batch to be flushed %v", flushed.Load())
+	}
+}
+
+func Test_Merge(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: "data0", value: n}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	left, right := m.If(func(d *kv) bool {
+		return d.value%2 == 0
+	})
+
+	out := Merge(
+		left.Then(func(d *kv) *kv {
+			d.name = "left"
+			return d
+		}),
+		right.Then(func(d *kv) *kv {
+			d.name = "right"
+			return d
+		}),
+	).Then(func(d *kv) *kv {
+		return d
+	}).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	counts := map[string]int{}
+	for n := 0; n < count; n++ {
+		select {
+		case d := <-out:
+			counts[d.name]++
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+
+	if counts["left"] != count/2 || counts["right"] != count/2 {
+		b.Errorf("unexpected counts %v", counts)
+	}
+
+	_, first := New("first_id", make(chan *kv))
+	_, other := New("other_id", make(chan *kv))
+	Merge(first.Then(func(d *kv) *kv { return d }), other).Output()
+
+	if dot := other.Describe().DOT(); !strings.Contains(dot, "first_id") || !strings.Contains(dot, "other_id") {
+		b.Errorf("expected both inputs in graph %s", dot)
+	}
+}
+
+func Test_Merge_Loop(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: "data0", value: n % 10}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	loop, out := m.While(func(d *kv) bool {
+		return d.value < 10
+	})
+
+	left, right := loop.If(func(d *kv) bool {
+		return d.value%2 == 0
+	})
+
+	Merge(
+		left.Then(func(d *kv) *kv {
+			d.value++
+			return d
+		}),
+		right.Then(func(d *kv) *kv {
+			d.value += 2
+			return d
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		select {
+		case d := <-out.Output():
+			if d.value < 10 {
+				b.Errorf("unexpected payload %v", d)
+			}
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+
+	if !strings.Contains(m.Describe().DOT(), "(merge)") {
+		b.Errorf("expected merge in graph")
+	}
+}
+
+func Test_Broadcast(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	branches := m.Broadcast(3, deepcopy)
+	if len(branches) != 3 {
+		b.Errorf("unexpected branches %v", len(branches))
+		b.FailNow()
+	}
+
+	outputs := []chan *kv{}
+	for i, branch := range branches {
+		outputs = append(outputs, branch.Then(func(d *kv) *kv {
+			d.value += i
+			return d
+		}).Output())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		for i, out := range outputs {
+			select {
+			case d := <-out:
+				if d.value != testPayloadBase.value+i {
+					b.Errorf("unexpected payload %v on branch %v", d, i)
+				}
+			case <-time.After(time.Second):
+				b.Errorf("timeout waiting for payload %v on branch %v", n, i)
+				b.FailNow()
+			}
+		}
+	}
+}
+
+func Test_BroadcastNamed(b *testing.T) {
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	branches := m.BroadcastNamed(deepcopy, "audit", "billing")
+	if len(branches) != 2 || branches["audit"] == nil || branches["billing"] == nil {
+		b.Errorf("unexpected branches %v", branches)
+		b.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	channel <- deepcopy(testPayloadBase)
+
+	audit := <-branches["audit"].Output()
+	billing := <-branches["billing"].Output()
+
+	if audit == billing {
+		b.Errorf("expected branches to receive copies of the payload")
+	}
+
+	if !strings.Contains(m.Describe().Mermaid(), "|billing|") {
+		b.Errorf("expected named branch in graph")
+	}
+
+	_, m2 := New("machine_id", make(chan *kv))
+	for name, fn := range map[string]func(){
+		"duplicate names": func() { m2.BroadcastNamed(deepcopy, "audit", "audit") },
+		"no names":        func() { m2.BroadcastNamed(deepcopy) },
+		"no branches":     func() { m2.Broadcast(-1, deepcopy) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					b.Errorf("expected panic for %s", name)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func Test_Partition(b *testing.T) {
+	count := 1000
+	keys := 10
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: strconv.Itoa(n % keys), value: n}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	out := Partition(m, func(d *kv) string {
+		return d.name
+	}, 4).Then(func(d *kv) *kv {
+		if d.value%7 == 0 {
+			<-time.After(time.Millisecond)
+		}
+		return d
+	}).Output()
+
+	if !strings.Contains(m.Describe().DOT(), "partition=4") {
+		b.Errorf("expected partition in graph")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	last := map[string]int{}
+	for n := 0; n < count; n++ {
+		select {
+		case d := <-out:
+			if v, ok := last[d.name]; ok && v > d.value {
+				b.Errorf("payload %v out of order for key %v", d.value, d.name)
+			}
+			last[d.name] = d.value
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+}
+
+func Test_Partition_Panic(b *testing.T) {
+	channel := make(chan *kv)
+	letters := make(chan string, 10)
+
+	startFn, m := New("machine_id",
+		channel,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			letters <- payload.(*kv).name
+		}),
+	)
+
+	out := Partition(m, func(d *kv) string {
+		if d.name == "key" {
+			panic("key")
+		}
+		return d.name
+	}, 2).Then(func(d *kv) *kv {
+		if d.name == "then" {
+			panic("then")
+		}
+		return d
+	}).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	channel <- &kv{name: "key"}
+	channel <- &kv{name: "then"}
+	channel <- &kv{name: "ok"}
+
+	if d := <-out; d.name != "ok" {
+		b.Errorf("unexpected payload %v", d)
+	}
+
+	seen := map[string]int{}
+	for n := 0; n < 2; n++ {
+		select {
+		case name := <-letters:
+			seen[name]++
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for dead letter %v", n)
+			b.FailNow()
+		}
+	}
+
+	select {
+	case name := <-letters:
+		b.Errorf("unexpected dead letter %v", name)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if seen["key"] != 1 || seen["then"] != 1 {
+		b.Errorf("expected one dead letter for each panic %v", seen)
+	}
+}
+
+func Test_MemoizeShared(b *testing.T) {
+	count := 100
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: "fib", value: 30}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	calls := &atomic.Int64{}
+	out := m.MemoizeShared(
+		func(f Monad[*kv]) Monad[*kv] {
+			return func(x *kv) *kv {
+				calls.Add(1)
+				if x.value < 3 {
+					return &kv{x.name, 1}
+				}
+				return &kv{x.name, f(&kv{x.name, x.value - 1}).value + f(&kv{x.name, x.value - 2}).value}
+			}
+		},
+		func(k *kv) string {
+			return strconv.Itoa(k.value)
+		},
+		100,
+		time.Minute,
+	).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		select {
+		case d := <-out:
+			if d.value != 832040 {
+				b.Errorf("unexpected result %v", d.value)
+			}
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+
+	// concurrent payloads can miss before the first result is cached
+	if calls.Load() > int64(30*count) {
+		b.Errorf("expected results to be shared across payloads %v", calls.Load())
+	}
+
+	cache := newLRU[int](2, 10*time.Millisecond)
+	cache.put("a", 1)
+	cache.put("b", 2)
+	cache.get("a")
+	cache.put("c", 3)
+
+	if _, ok := cache.get("b"); ok {
+		b.Errorf("expected least recently used entry to be evicted")
+	}
+
+	<-time.After(20 * time.Millisecond)
+
+	if _, ok := cache.get("a"); ok {
+		b.Errorf("expected entry to expire")
+	}
+}
+
+func Test_Limits(b *testing.T) {
+	channel := make(chan *kv)
+	exceeded := make(chan error, 10)
+	startFn, m := New("machine_id",
+		channel,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			exceeded <- err
+		}),
+	)
+
+	left, right := m.If(func(d *kv) bool {
+		return d.name == "recurse"
+	})
+
+	left.Recurse(func(f Monad[*kv]) Monad[*kv] {
+		return func(x *kv) *kv {
+			return f(x)
+		}
+	}).With(OptionMaxDepth(100)).Output()
+
+	loop, out := right.While(func(d *kv) bool {
+		return true
+	})
+	loop.Then(func(d *kv) *kv {
+		d.value++
+		return d
+	})
+	out.With(OptionMaxIterations(5, func(d *kv) string {
+		return d.name
+	})).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	channel <- &kv{name: "recurse"}
+	channel <- &kv{name: "while"}
+
+	seen := map[error]bool{}
+	for n := 0; n < 2; n++ {
+		select {
+		case err := <-exceeded:
+			seen[err] = true
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for dead letter %v", n)
+			b.FailNow()
+		}
+	}
+
+	if !seen[ErrMaxDepth] || !seen[ErrMaxIterations] {
+		b.Errorf("expected both limits to be exceeded %v", seen)
+	}
+
+	if !strings.Contains(m.Describe().DOT(), "max_iterations=5") {
+		b.Errorf("expected max_iterations in graph")
+	}
+}
+
+// blockingEdge ignores the context, so Send blocks until the payload is read from the Edge
+type blockingEdge[T any] chan T
+
+func (t blockingEdge[T]) Output() chan T {
+	return t
+}
+
+func (t blockingEdge[T]) Send(_ context.Context, payload T) {
+	t <- payload
+}
+
+func Test_Timeout(b *testing.T) {
+	channel := make(chan *kv)
+	letters := make(chan error, 10)
+	names := make(chan string, 10)
+	startFn, m := New("machine_id",
+		channel,
+		OptionFIF0,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			letters <- err
+			names <- payload.(*kv).name
+		}),
+	)
+
+	block := make(chan struct{})
+	defer close(block)
+
+	left, right := m.If(func(d *kv) bool {
+		return d.name != "edge"
+	})
+
+	out := left.Then(func(d *kv) *kv {
+		switch d.name {
+		case "slow":
+			<-time.After(50 * time.Millisecond)
+		case "panic":
+			<-time.After(50 * time.Millisecond)
+			panic("after the deadline")
+		case "never":
+			<-block
+		}
+		return d
+	}).With(OptionTimeout(20 * time.Millisecond))
+
+	next, timedOut := OnTimeout(right)
+	edge := blockingEdge[*kv](make(chan *kv))
+	next.Then(func(d *kv) *kv {
+		if d.value == 1 {
+			<-block
+		}
+		return d
+	}).With(OptionTimeout(100 * time.Millisecond)).
+		Distribute(edge).With(OptionTimeout(20 * time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	outputs := make(chan string, 10)
+	go func() {
+		for d := range out.Output() {
+			outputs <- d.name
+		}
+	}()
+
+	for _, name := range []string{"slow", "panic", "never", "fast"} {
+		channel <- &kv{name: name}
+	}
+	for n := 1; n <= 3; n++ {
+		channel <- &kv{name: "edge", value: n}
+	}
+
+	seen := map[string]bool{}
+	for n := 0; n < 3; n++ {
+		select {
+		case err := <-letters:
+			if !errors.Is(err, ErrTimeout) {
+				b.Errorf("expected ErrTimeout got %v", err)
+			}
+			seen[<-names] = true
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for dead letter %v", n)
+			b.FailNow()
+		}
+	}
+
+	if !seen["slow"] || !seen["panic"] || !seen["never"] {
+		b.Errorf("unexpected dead letters %v", seen)
+	}
+
+	select {
+	case name := <-outputs:
+		if name != "fast" {
+			b.Errorf("unexpected payload %v", name)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for output")
+		b.FailNow()
+	}
+
+	select {
+	case d := <-timedOut.Output():
+		if d.value != 1 {
+			b.Errorf("unexpected timed out payload %v", d)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for timed out payload")
+		b.FailNow()
+	}
+
+	// the Edge ignores the context, the payloads it was given are not reported
+	// as timed out while the stage carries on with the next payload
+	<-time.After(50 * time.Millisecond)
+	values := []int{}
+	for n := 0; n < 2; n++ {
+		select {
+		case d := <-edge:
+			values = append(values, d.value)
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for edge payload %v", n)
+			b.FailNow()
+		}
+	}
+
+	slices.Sort(values)
+	if !slices.Equal(values, []int{2, 3}) {
+		b.Errorf("unexpected edge payloads %v", values)
+	}
+
+	select {
+	case name := <-outputs:
+		b.Errorf("unexpected payload after timeout %v", name)
+	case d := <-timedOut.Output():
+		b.Errorf("unexpected timed out payload %v", d)
+	case err := <-letters:
+		b.Errorf("unexpected dead letter %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if !strings.Contains(m.Describe().DOT(), "timeout=20ms") {
+		b.Errorf("expected timeout in graph")
+	}
+}
+
+func Test_Limits_Values(b *testing.T) {
+	exceeded := make(chan any, 100)
+	deadLetter := OptionDeadLetter(func(vertexName string, payload any, err error) {
+		if errors.Is(err, ErrMaxIterations) {
+			exceeded <- payload
+		}
+	})
+	name := func(d kv) string {
+		return d.name
+	}
+
+	channel := make(chan kv)
+	startFn, m := New("machine_id", channel, deadLetter)
+
+	loop, out := m.While(func(d kv) bool {
+		return d.name == "runaway" || d.value%10 != 0
+	})
+	loop.Then(func(d kv) kv {
+		d.value++
+		return d
+	})
+	out.With(OptionMaxIterations(10, name))
+
+	channel2 := make(chan kv)
+	startFn2, m2 := New("machine_id", channel2, deadLetter)
+
+	back, exit := WhileTransform(m2, func(d kv) bool {
+		return d.name == "runaway" || d.value < 5
+	}, func(d kv) *kv {
+		return &d
+	}, func(d *kv) kv {
+		return *d
+	})
+	back.Then(func(d *kv) *kv {
+		d.value++
+		return d
+	})
+	exit.With(OptionMaxIterations(5, name))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+	startFn2(ctx)
+
+	// steady traffic keeps going through the loops while the runaway payloads go around
+	outputs := &atomic.Int64{}
+	go func() {
+		for {
+			select {
+			case d := <-out.Output():
+				if d.value%10 != 0 {
+					b.Errorf("unexpected payload %v", d)
+				}
+			case d := <-exit.Output():
+				if d.value != 5 {
+					b.Errorf("unexpected payload %v", d)
+				}
+			case <-ctx.Done():
+				return
+			}
+			outputs.Add(1)
+		}
+	}()
+
+	go func() {
+		channel <- kv{name: "runaway"}
+		channel2 <- kv{name: "runaway"}
+		for n := 0; ; n++ {
+			select {
+			case channel <- kv{name: strconv.Itoa(n), value: n*10 + 1}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case channel2 <- kv{name: strconv.Itoa(n)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	letters := []any{}
+	for len(letters) < 2 {
+		select {
+		case d := <-exceeded:
+			letters = append(letters, d)
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for dead letters %v", letters)
+			b.FailNow()
+		}
+	}
+
+	// each runaway payload is stopped once it has gone around the limit
+	if !slices.Contains(letters, any(kv{name: "runaway", value: 10})) ||
+		!slices.Contains(letters, any(kv{name: "runaway", value: 5})) {
+		b.Errorf("unexpected dead letters %v", letters)
+	}
+
+	if outputs.Load() == 0 {
+		b.Errorf("expected the other payloads to leave the loops")
+	}
+}
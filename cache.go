@@ -0,0 +1,82 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru is a concurrency safe cache that evicts the least recently used entry once it
+// holds size entries, entries also expire after the ttl if it is > 0.
+type lru[T any] struct {
+	m     sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List
+}
+
+type lruEntry[T any] struct {
+	key     string
+	value   T
+	expires time.Time
+}
+
+func newLRU[T any](size int, ttl time.Duration) *lru[T] {
+	return &lru[T]{
+		size:  size,
+		ttl:   ttl,
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+func (c *lru[T]) get(key string) (T, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var value T
+
+	e, ok := c.items[key]
+	if !ok {
+		return value, false
+	}
+
+	entry := e.Value.(*lruEntry[T])
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(e)
+		return value, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lru[T]) put(key string, value T) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*lruEntry[T])
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[T]{key: key, value: value, expires: expires})
+
+	if c.size > 0 && c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lru[T]) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.items, e.Value.(*lruEntry[T]).key)
+}
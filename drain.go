@@ -0,0 +1,216 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const drainPollInterval = 10 * time.Millisecond
+
+// DrainReport holds the DrainStats for each vertex, keyed by the vertex name
+type DrainReport map[string]DrainStats
+
+// DrainStats holds the number of payloads a vertex processed after the intake was
+// closed and the number of payloads that were stranded and sent to the flush function.
+type DrainStats struct {
+	Drained int64
+	Flushed int64
+}
+
+// OptionDrain enables a graceful shutdown. When the context is cancelled the intake is
+// closed and the payloads that were already accepted are allowed to run through the
+// remaining vertices for up to the gracePeriod. Only then is the Machine cancelled and any
+// stranded payloads, including those left in the input, sent to the OptionFlush function.
+// The reportFN is called with the number of payloads drained and flushed by each vertex,
+// and by the name of the Machine for the input, once every vertex has exited.
+func OptionDrain(gracePeriod time.Duration, reportFN func(DrainReport)) Option {
+	return &option{func(c *config) { c.drainPeriod = gracePeriod; c.drainFN = reportFN }}
+}
+
+// drain is stored in the context of a Machine using OptionDrain to track the
+// payloads in flight.
+type drain struct {
+	active    atomic.Int64
+	draining  atomic.Bool
+	transfers sync.WaitGroup
+	m         sync.Mutex
+	queues    []func() int
+	stats     map[string]*DrainStats
+}
+
+func drainFrom(ctx context.Context) *drain {
+	d, _ := ctx.Value(drainKey).(*drain)
+	return d
+}
+
+// runDrained starts the Machine behind an intake that stops reading the input when the
+// context is cancelled, while the vertices keep running until they have settled.
+func runDrained[T any](ctx context.Context, b *builder[T], input chan T) {
+	d := &drain{stats: map[string]*DrainStats{}}
+	c, cancel := context.WithCancel(context.WithValue(context.WithoutCancel(ctx), drainKey, d))
+	intake := make(chan T)
+
+	b.start(c, intake)
+
+	// rest holds the payload read by the intake as it stopped, or that the vertices
+	// stopped before accepting
+	rest := make(chan []T, 1)
+
+	spawn(ctx, func() {
+		var pending []T
+		defer func() { rest <- pending }()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case data := <-input:
+				if ctx.Err() != nil {
+					pending = append(pending, data)
+					return
+				}
+
+				d.add(1)
+				select {
+				case <-c.Done():
+					pending = append(pending, data)
+				case intake <- data:
+				}
+				d.add(-1)
+			}
+
+			if pending != nil {
+				return
+			}
+		}
+	})
+
+	spawn(ctx, func() {
+		<-ctx.Done()
+		d.draining.Store(true)
+		d.settle(b.option.drainPeriod)
+		cancel()
+		d.transfers.Wait()
+
+		// the intake has stopped reading, so the payloads left in the input were
+		// never accepted and are flushed under the name of the Machine
+		option := b.option
+		if b.flush != nil {
+			option = option.clone()
+			option.typedFlush = b.flush
+		}
+
+		pending := <-rest
+		if f := flusher[T](b.name, option); f != nil {
+			flush(b.name, input, pending, f, d)
+		}
+
+		if b.option.drainFN != nil {
+			b.option.drainFN(d.report())
+		}
+	})
+}
+
+func (d *drain) add(n int64) {
+	if d != nil {
+		d.active.Add(n)
+	}
+}
+
+// watch registers a channel consumed by a transfer
+func (d *drain) watch(queue func() int) {
+	if d == nil {
+		return
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.transfers.Add(1)
+	d.queues = append(d.queues, queue)
+}
+
+func (d *drain) done() {
+	if d != nil {
+		d.transfers.Done()
+	}
+}
+
+func (d *drain) drained(vertexName string) {
+	if d != nil && d.draining.Load() && vertexName != "" {
+		d.record(vertexName, func(s *DrainStats) { s.Drained++ })
+	}
+}
+
+func (d *drain) flushed(vertexName string) {
+	if d != nil && vertexName != "" {
+		d.record(vertexName, func(s *DrainStats) { s.Flushed++ })
+	}
+}
+
+func (d *drain) record(vertexName string, fn func(s *DrainStats)) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if _, ok := d.stats[vertexName]; !ok {
+		d.stats[vertexName] = &DrainStats{}
+	}
+
+	fn(d.stats[vertexName])
+}
+
+// settle waits until there are no payloads in flight for two consecutive polls or
+// the gracePeriod has expired.
+func (d *drain) settle(gracePeriod time.Duration) {
+	deadline := time.After(gracePeriod)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	idle := false
+	for {
+		select {
+		case <-deadline:
+			return
+		case <-ticker.C:
+			if d.idle() && idle {
+				return
+			}
+			idle = d.idle()
+		}
+	}
+}
+
+func (d *drain) idle() bool {
+	if d.active.Load() > 0 {
+		return false
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for _, queue := range d.queues {
+		if queue() > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (d *drain) report() DrainReport {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	out := DrainReport{}
+	for k, v := range d.stats {
+		out[k] = *v
+	}
+
+	return out
+}
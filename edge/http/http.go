@@ -33,7 +33,10 @@ func (e *edge[T]) Send(ctx context.Context, data T) {
 		panic(err)
 	}
 
-	e.channel <- out
+	select {
+	case <-ctx.Done():
+	case e.channel <- out:
+	}
 }
 
 // New returns a function that can be used to make http requests
@@ -0,0 +1,92 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventTime is a function for processing the payloads by the time they occurred rather than
+// the time they were received. The watermark is the latest event time seen minus the
+// maxOutOfOrder, payloads with an event time before the watermark are late and sent to the
+// late branch. Windows built from the onTime branch use the event time to assign payloads and
+// close once the watermark passes their end, payloads arriving after their windows have closed
+// are also sent to the late branch. The event time is used until the type of the Machine is
+// changed. The watermark only advances as payloads are received.
+func EventTime[T any](m Machine[T], ts func(d T) time.Time, maxOutOfOrder time.Duration) (onTime, late Machine[T]) {
+	x := m.(*builder[T])
+
+	name := x.name + ":" + "eventtime"
+	n := x.attach("eventtime", name, map[string]string{
+		"max_out_of_order": maxOutOfOrder.String(),
+	})
+	stage := n.stage
+
+	left := child(x, n, name+":on_time", "on_time", x.loop)
+	right := child(x, n, name+":late", "late", x.loop)
+
+	clock := &eventClock[T]{ts: ts, maxOutOfOrder: maxOutOfOrder, late: right}
+	left.clock = clock
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+		wm := clock.watermark()
+		vertex[T](func(ctx context.Context, payload T) {
+			if wm.observe(ts(payload)) {
+				send(ctx, right.output, payload)
+			} else {
+				send(ctx, left.output, payload)
+			}
+		}).run(ctx, name, channel, stage)
+	}
+
+	return left, right
+}
+
+// eventClock is the event time set by EventTime, it is inherited by the builders
+// created from the onTime branch.
+type eventClock[T any] struct {
+	ts            func(d T) time.Time
+	maxOutOfOrder time.Duration
+	late          *builder[T]
+}
+
+// watermark is tracked by each vertex using the event time, based on the payloads
+// the vertex has received.
+type watermark struct {
+	m             sync.Mutex
+	maxOutOfOrder time.Duration
+	t             time.Time
+}
+
+func (c *eventClock[T]) watermark() *watermark {
+	return &watermark{maxOutOfOrder: c.maxOutOfOrder}
+}
+
+// observe advances the watermark and reports whether ts is late
+func (w *watermark) observe(ts time.Time) bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if ts.Before(w.t) {
+		return true
+	}
+
+	if t := ts.Add(-w.maxOutOfOrder); t.After(w.t) {
+		w.t = t
+	}
+
+	return false
+}
+
+func (w *watermark) now() time.Time {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.t
+}
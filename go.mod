@@ -1,5 +1,5 @@
 module github.com/whitaker-io/machine/v3
 
-go 1.22.1
+go 1.23
 
 require github.com/whitaker-io/machine/common v0.1.1
@@ -0,0 +1,266 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Graph is a description of the topology of a Machine
+type Graph struct {
+	// Name is the name provided to New
+	Name  string
+	Nodes []Node
+	Links []Link
+}
+
+// Node is a vertex in the Graph. The input provided to New and any channels
+// that are not consumed by another vertex are included with the types
+// "input" and "output".
+type Node struct {
+	ID      int
+	Type    string
+	Name    string
+	Path    string
+	Options map[string]string
+}
+
+// Link is a connection between two Nodes in the Graph, Loop is set for
+// the back edges created by While.
+type Link struct {
+	From  int
+	To    int
+	Label string
+	Loop  bool
+}
+
+type graph struct {
+	m     sync.Mutex
+	name  string
+	nodes []*node
+	ports []*port
+	// into is set once the graph has been merged into another
+	into *graph
+}
+
+type node struct {
+	id       int
+	typeName string
+	path     string
+	stage    *config
+	options  map[string]string
+}
+
+// port is the channel between two vertices, to is nil until the channel is consumed
+type port struct {
+	from  *node
+	to    *node
+	label string
+	name  string
+	loop  *port
+}
+
+// merge moves the nodes and ports of other into g, for the vertices that consume
+// Machines created by different calls to New. Both graphs describe the result.
+func (g *graph) merge(other *graph) {
+	g, other = g.resolve(), other.resolve()
+	if g == other {
+		return
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	other.m.Lock()
+	defer other.m.Unlock()
+
+	for _, n := range other.nodes {
+		n.id += len(g.nodes)
+	}
+
+	g.nodes = append(g.nodes, other.nodes...)
+	g.ports = append(g.ports, other.ports...)
+	other.nodes, other.ports, other.into = nil, nil, g
+}
+
+// resolve returns the graph that g has been merged into, or g
+func (g *graph) resolve() *graph {
+	g.m.Lock()
+	into := g.into
+	g.m.Unlock()
+
+	if into == nil {
+		return g
+	}
+
+	return into.resolve()
+}
+
+func (g *graph) node(typeName, path string, stage *config, options map[string]string) *node {
+	if into := g.resolve(); into != g {
+		return into.node(typeName, path, stage, options)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	n := &node{
+		id:       len(g.nodes),
+		typeName: typeName,
+		path:     path,
+		stage:    stage,
+		options:  options,
+	}
+	g.nodes = append(g.nodes, n)
+
+	return n
+}
+
+func (g *graph) port(from *node, label, name string, loop *port) *port {
+	if into := g.resolve(); into != g {
+		return into.port(from, label, name, loop)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	p := &port{
+		from:  from,
+		label: label,
+		name:  name,
+		loop:  loop,
+	}
+	g.ports = append(g.ports, p)
+
+	return p
+}
+
+func (g *graph) describe() Graph {
+	if into := g.resolve(); into != g {
+		return into.describe()
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	out := Graph{Name: g.name}
+
+	for _, n := range g.nodes {
+		out.Nodes = append(out.Nodes, n.describe())
+	}
+
+	for _, p := range g.ports {
+		switch {
+		case p.to != nil:
+			out.Links = append(out.Links, Link{From: p.from.id, To: p.to.id, Label: p.label})
+		case p.loop != nil && p.loop.to != nil:
+			out.Links = append(out.Links, Link{From: p.from.id, To: p.loop.to.id, Label: "loop", Loop: true})
+		default:
+			id := len(out.Nodes)
+			out.Nodes = append(out.Nodes, Node{ID: id, Type: "output", Name: p.name, Path: p.name})
+			out.Links = append(out.Links, Link{From: p.from.id, To: id, Label: p.label})
+		}
+	}
+
+	return out
+}
+
+func (n *node) describe() Node {
+	out := Node{
+		ID:      n.id,
+		Type:    n.typeName,
+		Name:    n.path,
+		Path:    n.path,
+		Options: map[string]string{},
+	}
+
+	if n.stage != nil {
+		out.Name = n.stage.vertexName(n.path)
+		out.Options = n.stage.describe()
+	}
+
+	for k, v := range n.options {
+		out.Options[k] = v
+	}
+
+	return out
+}
+
+// DOT renders the Graph in the Graphviz DOT language
+func (g Graph) DOT() string {
+	sb := &strings.Builder{}
+
+	fmt.Fprintf(sb, "digraph %s {\n", strconv.Quote(g.Name))
+	for _, n := range g.Nodes {
+		fmt.Fprintf(sb, "  n%d [label=%s];\n", n.ID, strconv.Quote(strings.Join(n.lines(), "\n")))
+	}
+
+	for _, l := range g.Links {
+		attrs := []string{}
+		if l.Label != "" {
+			attrs = append(attrs, "label="+strconv.Quote(l.Label))
+		}
+		if l.Loop {
+			attrs = append(attrs, "style=dashed")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(sb, "  n%d -> n%d [%s];\n", l.From, l.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(sb, "  n%d -> n%d;\n", l.From, l.To)
+		}
+	}
+	sb.WriteString("}\n")
+
+	return sb.String()
+}
+
+// Mermaid renders the Graph as a Mermaid flowchart
+func (g Graph) Mermaid() string {
+	sb := &strings.Builder{}
+	escape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+
+	sb.WriteString("flowchart TD\n")
+	for _, n := range g.Nodes {
+		lines := n.lines()
+		for i := range lines {
+			lines[i] = escape.Replace(lines[i])
+		}
+		fmt.Fprintf(sb, "  n%d[\"%s\"]\n", n.ID, strings.Join(lines, "<br/>"))
+	}
+
+	for _, l := range g.Links {
+		arrow := "-->"
+		if l.Loop {
+			arrow = "-.->"
+		}
+
+		if l.Label != "" {
+			fmt.Fprintf(sb, "  n%d %s|%s| n%d\n", l.From, arrow, escape.Replace(l.Label), l.To)
+		} else {
+			fmt.Fprintf(sb, "  n%d %s n%d\n", l.From, arrow, l.To)
+		}
+	}
+
+	return sb.String()
+}
+
+func (n Node) lines() []string {
+	out := []string{n.Name, "(" + n.Type + ")"}
+
+	keys := make([]string, 0, len(n.Options))
+	for k := range n.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		out = append(out, k+"="+n.Options[k])
+	}
+
+	return out
+}
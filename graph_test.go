@@ -0,0 +1,90 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_Describe(b *testing.T) {
+	_, m := New("machine_id", make(chan *kv))
+
+	loop, out := m.
+		Then(
+			func(d *kv) *kv {
+				return d
+			},
+		).Named("enrich").With(OptionFIF0).
+		While(
+			func(d *kv) bool {
+				return d.value < 10
+			},
+		)
+
+	loop.Then(
+		func(d *kv) *kv {
+			d.value++
+			return d
+		},
+	)
+
+	left, right := out.Distribute(channelEdge[*kv](make(chan *kv))).Tee(
+		func(d *kv) (*kv, *kv) {
+			return d, deepcopy(d)
+		},
+	)
+	right.Drop()
+
+	x, _ := Transform(left, func(d *kv) int {
+		return d.value
+	})
+
+	g := x.Describe()
+
+	types := map[string]Node{}
+	for _, n := range g.Nodes {
+		if _, ok := types[n.Type]; !ok {
+			types[n.Type] = n
+		}
+	}
+
+	for _, t := range []string{"input", "then", "while", "distribute", "tee", "drop", "transform", "output"} {
+		if _, ok := types[t]; !ok {
+			b.Errorf("missing node type %s", t)
+		}
+	}
+
+	if n := types["then"]; n.Name != "enrich" || n.Path != "machine_id:then" || n.Options["fifo"] != "true" {
+		b.Errorf("unexpected node %v", n)
+	}
+
+	if n := types["transform"]; n.Options["from"] != "*machine.kv" || n.Options["to"] != "int" {
+		b.Errorf("unexpected node %v", n)
+	}
+
+	loops := 0
+	for _, l := range g.Links {
+		if l.Loop {
+			loops++
+			if l.To != types["while"].ID {
+				b.Errorf("loop should point to the while node %v", l)
+			}
+		}
+	}
+
+	if loops != 1 || len(g.Links) != len(g.Nodes) {
+		b.Errorf("unexpected links %v", g.Links)
+	}
+
+	if dot := g.DOT(); !strings.HasPrefix(dot, `digraph "machine_id" {`) || !strings.Contains(dot, "style=dashed") {
+		b.Errorf("unexpected dot output %s", dot)
+	}
+
+	if mermaid := g.Mermaid(); !strings.HasPrefix(mermaid, "flowchart TD") || !strings.Contains(mermaid, "-.->|loop|") {
+		b.Errorf("unexpected mermaid output %s", mermaid)
+	}
+}
@@ -0,0 +1,327 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Unmatched is a payload that expired from a Join without a match, only one of Left
+// or Right is set.
+type Unmatched[A, B any] struct {
+	Left  *A
+	Right *B
+}
+
+// Join is a function for correlating the payloads of two Machines by key. Each payload is
+// held for the ttl and combined with fn with every payload from the other Machine that has
+// the same key while it is held. Payloads that expire without a match are sent to the
+// expired branch. Use OptionMaxPending on the joined branch to bound the number of payloads
+// held, the oldest are expired early once it is reached. When the context is cancelled the
+// held payloads that have not been matched are sent to the flush function. Neither Machine
+// can be part of a loop.
+//
+//nolint:revive
+func Join[A, B any, K comparable, O any](
+	left Machine[A],
+	right Machine[B],
+	keyA func(a A) K,
+	keyB func(b B) K,
+	fn func(a A, b B) O,
+	ttl time.Duration,
+) (joined Machine[O], expired Machine[Unmatched[A, B]], err error) {
+	return join(left, right, &joiner[A, B, K, O]{keyA: keyA, keyB: keyB, fn: fn, ttl: ttl})
+}
+
+// LeftJoin is a function for correlating the payloads of two Machines by key like Join,
+// except that payloads from left that expire without a match are combined with the zero
+// value of B and sent to the joined branch instead of the expired branch.
+//
+//nolint:revive
+func LeftJoin[A, B any, K comparable, O any](
+	left Machine[A],
+	right Machine[B],
+	keyA func(a A) K,
+	keyB func(b B) K,
+	fn func(a A, b B) O,
+	ttl time.Duration,
+) (joined Machine[O], expired Machine[Unmatched[A, B]], err error) {
+	return join(left, right, &joiner[A, B, K, O]{keyA: keyA, keyB: keyB, fn: fn, ttl: ttl, outer: true})
+}
+
+func join[A, B any, K comparable, O any](
+	left Machine[A],
+	right Machine[B],
+	j *joiner[A, B, K, O],
+) (Machine[O], Machine[Unmatched[A, B]], error) {
+	l := left.(*builder[A])
+	r := right.(*builder[B])
+
+	if l.loop != nil || r.loop != nil {
+		return nil, nil, fmt.Errorf("join cannot be used in a loop")
+	} else if j.ttl <= 0 {
+		return nil, nil, fmt.Errorf("join ttl must be greater than 0")
+	}
+
+	kind := "inner"
+	if j.outer {
+		kind = "left"
+	}
+
+	l.graph.merge(r.graph)
+
+	name := l.name + ":" + "join"
+	n := l.attach("join", name, map[string]string{
+		"join": kind,
+		"ttl":  j.ttl.String(),
+	})
+	r.port.to = n
+	stage := n.stage
+	var inner *config
+
+	joined := child[A, O](l, n, name, "", nil)
+	expired := child[A, Unmatched[A, B]](l, n, name+":expired", "expired", nil)
+	joined.buffer = func(size int) { l.resize(size); r.resize(size) }
+	expired.buffer = joined.buffer
+
+	j.state = map[K]*joinState[K, A, B]{}
+	j.order = list.New()
+	j.output = joined
+	j.expired = expired
+
+	once := &sync.Once{}
+	setup := func(ctx context.Context) {
+		once.Do(func() {
+			j.limit = stage.maxPending
+			inner = stage.untimed()
+			joined.setup(ctx)
+			expired.setup(ctx)
+			spawn(ctx, func() { j.sweep(ctx, name, inner) })
+		})
+	}
+
+	l.start = func(ctx context.Context, channel chan A) {
+		setup(ctx)
+		vertex[A](func(ctx context.Context, payload A) {
+			matches, lefts, rights := j.addLeft(payload)
+			for _, b := range matches {
+				send(ctx, joined.output, j.fn(payload, b))
+			}
+			j.release(ctx, lefts, rights, j.unmatched)
+		}).run(ctx, name, channel, inner)
+	}
+
+	r.start = func(ctx context.Context, channel chan B) {
+		setup(ctx)
+		vertex[B](func(ctx context.Context, payload B) {
+			matches, lefts, rights := j.addRight(payload)
+			for _, a := range matches {
+				send(ctx, joined.output, j.fn(a, payload))
+			}
+			j.release(ctx, lefts, rights, j.unmatched)
+		}).run(ctx, name, channel, inner)
+	}
+
+	return joined, expired, nil
+}
+
+type joiner[A, B any, K comparable, O any] struct {
+	keyA    func(a A) K
+	keyB    func(b B) K
+	fn      func(a A, b B) O
+	ttl     time.Duration
+	outer   bool
+	limit   int
+	m       sync.Mutex
+	state   map[K]*joinState[K, A, B]
+	order   *list.List
+	output  *builder[O]
+	expired *builder[Unmatched[A, B]]
+}
+
+type joinState[K comparable, A, B any] struct {
+	left  []*joinEntry[K, A]
+	right []*joinEntry[K, B]
+}
+
+// joinRef is the position of a held payload in the order they arrived, only one of
+// left or right is set.
+type joinRef[K comparable, A, B any] struct {
+	left    *joinEntry[K, A]
+	right   *joinEntry[K, B]
+	expires time.Time
+}
+
+type joinEntry[K comparable, T any] struct {
+	key     K
+	data    T
+	expires time.Time
+	matched bool
+}
+
+// addLeft holds the payload and returns the payloads from right that it matches, along with
+// the payloads that were evicted to stay within the limit and were never matched.
+func (j *joiner[A, B, K, O]) addLeft(a A) (matches []B, lefts []A, rights []B) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	k := j.keyA(a)
+	st := j.get(k)
+	for _, e := range st.right {
+		matches = append(matches, e.data)
+		e.matched = true
+	}
+
+	e := &joinEntry[K, A]{key: k, data: a, expires: time.Now().Add(j.ttl), matched: len(matches) > 0}
+	st.left = append(st.left, e)
+	j.order.PushBack(&joinRef[K, A, B]{left: e, expires: e.expires})
+
+	lefts, rights = j.evict()
+	return matches, lefts, rights
+}
+
+// addRight holds the payload and returns the payloads from left that it matches, along with
+// the payloads that were evicted to stay within the limit and were never matched.
+func (j *joiner[A, B, K, O]) addRight(b B) (matches []A, lefts []A, rights []B) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	k := j.keyB(b)
+	st := j.get(k)
+	for _, e := range st.left {
+		matches = append(matches, e.data)
+		e.matched = true
+	}
+
+	e := &joinEntry[K, B]{key: k, data: b, expires: time.Now().Add(j.ttl), matched: len(matches) > 0}
+	st.right = append(st.right, e)
+	j.order.PushBack(&joinRef[K, A, B]{right: e, expires: e.expires})
+
+	lefts, rights = j.evict()
+	return matches, lefts, rights
+}
+
+func (j *joiner[A, B, K, O]) get(k K) *joinState[K, A, B] {
+	st, ok := j.state[k]
+	if !ok {
+		st = &joinState[K, A, B]{}
+		j.state[k] = st
+	}
+
+	return st
+}
+
+// unmatched sends a payload from left that was never matched to the joined branch of a LeftJoin
+func (j *joiner[A, B, K, O]) unmatched(ctx context.Context, a A) {
+	var b B
+	send(ctx, j.output.output, j.fn(a, b))
+}
+
+// release sends the payloads that were never matched to the expired branch, or to outer
+// for the payloads from left of a LeftJoin.
+func (j *joiner[A, B, K, O]) release(ctx context.Context, lefts []A, rights []B, outer vertex[A]) {
+	for _, a := range lefts {
+		if j.outer {
+			outer(ctx, a)
+		} else {
+			send(ctx, j.expired.output, Unmatched[A, B]{Left: &a})
+		}
+	}
+
+	for _, b := range rights {
+		send(ctx, j.expired.output, Unmatched[A, B]{Right: &b})
+	}
+}
+
+// sweep removes the payloads that have expired until the context is done, then sends the
+// payloads that were never matched to the flush function.
+func (j *joiner[A, B, K, O]) sweep(ctx context.Context, path string, option *config) {
+	vertexName := option.vertexName(path)
+	outer := vertex[A](j.unmatched).wrap(vertexName, option.labels(path), option)
+
+	ticker := time.NewTicker(max(j.ttl/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			lefts, rights := j.expire(time.Time{})
+
+			if f := flusher[A](vertexName, option); f != nil {
+				flush(vertexName, nil, lefts, f, nil)
+			}
+
+			if f := flusher[B](vertexName, option); f != nil {
+				flush(vertexName, nil, rights, f, nil)
+			}
+			return
+		case now := <-ticker.C:
+			lefts, rights := j.expire(now)
+			j.release(ctx, lefts, rights, outer)
+		}
+	}
+}
+
+// expire removes the payloads that expired at or before now, or all of them if now is
+// zero, and returns the ones that were never matched.
+func (j *joiner[A, B, K, O]) expire(now time.Time) (lefts []A, rights []B) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	return j.remove(func(expires time.Time) bool {
+		return now.IsZero() || !expires.After(now)
+	})
+}
+
+// evict removes the oldest payloads while there are more than the limit and returns
+// the ones that were never matched, it must be called with the lock held.
+func (j *joiner[A, B, K, O]) evict() (lefts []A, rights []B) {
+	if j.limit <= 0 {
+		return nil, nil
+	}
+
+	return j.remove(func(time.Time) bool { return j.order.Len() > j.limit })
+}
+
+// remove pops the oldest payloads while ok returns true for their expiry, payloads are held
+// in the order they arrived and so are always the first of their key.
+func (j *joiner[A, B, K, O]) remove(ok func(expires time.Time) bool) (lefts []A, rights []B) {
+	for e := j.order.Front(); e != nil; e = j.order.Front() {
+		ref := e.Value.(*joinRef[K, A, B])
+		if !ok(ref.expires) {
+			break
+		}
+		j.order.Remove(e)
+
+		if entry := ref.left; entry != nil {
+			st := j.state[entry.key]
+			st.left[0], st.left = nil, st.left[1:]
+			if !entry.matched {
+				lefts = append(lefts, entry.data)
+			}
+			j.clean(entry.key, st)
+		} else {
+			entry := ref.right
+			st := j.state[entry.key]
+			st.right[0], st.right = nil, st.right[1:]
+			if !entry.matched {
+				rights = append(rights, entry.data)
+			}
+			j.clean(entry.key, st)
+		}
+	}
+
+	return lefts, rights
+}
+
+func (j *joiner[A, B, K, O]) clean(k K, st *joinState[K, A, B]) {
+	if len(st.left) == 0 && len(st.right) == 0 {
+		delete(j.state, k)
+	}
+}
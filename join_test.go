@@ -0,0 +1,202 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Join(b *testing.T) {
+	count := 100
+	orders := make(chan *kv)
+	payments := make(chan string)
+
+	startOrders, left := New("orders", orders)
+	startPayments, right := New("payments", payments)
+
+	joined, expired, err := Join(left, right,
+		func(a *kv) string { return a.name },
+		func(b string) string { return b },
+		func(a *kv, b string) string {
+			return a.name + ":" + b
+		},
+		50*time.Millisecond,
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	for _, g := range []Graph{left.Describe(), right.Describe(), joined.Describe()} {
+		inputs := 0
+		for _, n := range g.Nodes {
+			if n.Type == "input" {
+				inputs++
+			}
+		}
+
+		for _, l := range g.Links {
+			if l.From == l.To || g.Nodes[l.To].Type == "input" {
+				b.Errorf("unexpected link %v in %s", l, g.DOT())
+			}
+		}
+
+		if inputs != 2 || !strings.Contains(g.DOT(), "payments") {
+			b.Errorf("expected both inputs in graph %s", g.DOT())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startOrders(ctx)
+	startPayments(ctx)
+
+	go func() {
+		for n := 0; n < count; n++ {
+			orders <- &kv{name: strconv.Itoa(n)}
+		}
+		orders <- &kv{name: "unmatched"}
+	}()
+
+	go func() {
+		for n := count - 1; n >= 0; n-- {
+			payments <- strconv.Itoa(n)
+		}
+	}()
+
+	for n := 0; n < count; n++ {
+		select {
+		case out := <-joined.Output():
+			if out[:len(out)/2] != out[len(out)/2+1:] {
+				b.Errorf("unexpected join %v", out)
+			}
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for join %v", n)
+			b.FailNow()
+		}
+	}
+
+	select {
+	case out := <-expired.Output():
+		if out.Left == nil || (*out.Left).name != "unmatched" || out.Right != nil {
+			b.Errorf("unexpected expired payload %v", out)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for expired payload")
+	}
+}
+
+func Test_LeftJoin(b *testing.T) {
+	orders := make(chan *kv)
+	payments := make(chan string)
+
+	startOrders, left := New("orders", orders)
+	startPayments, right := New("payments", payments)
+
+	joined, expired, err := LeftJoin(left, right,
+		func(a *kv) string { return a.name },
+		func(b string) string { return b },
+		func(a *kv, b string) string {
+			return a.name + ":" + b
+		},
+		20*time.Millisecond,
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	_, m2 := New("machine_id", make(chan *kv))
+	loop, _ := m2.While(func(d *kv) bool {
+		return false
+	})
+
+	if _, _, err := Join(loop, right, func(a *kv) string { return a.name }, func(b string) string { return b }, func(a *kv, b string) string { return b }, time.Second); err == nil {
+		b.Errorf("expected error for Join inside of a loop")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startOrders(ctx)
+	startPayments(ctx)
+
+	orders <- &kv{name: "order"}
+	payments <- "payment"
+
+	select {
+	case out := <-joined.Output():
+		if out != "order:" {
+			b.Errorf("unexpected join %v", out)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for join")
+	}
+
+	select {
+	case out := <-expired.Output():
+		if out.Right == nil || *out.Right != "payment" || out.Left != nil {
+			b.Errorf("unexpected expired payload %v", out)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for expired payload")
+	}
+}
+
+func Test_Join_MaxPending(b *testing.T) {
+	orders := make(chan *kv)
+	payments := make(chan string)
+
+	startOrders, left := New("orders", orders, OptionFIF0)
+	startPayments, right := New("payments", payments)
+
+	joined, expired, err := Join(left, right,
+		func(a *kv) string { return a.name },
+		func(b string) string { return b },
+		func(a *kv, b string) string {
+			return a.name + ":" + b
+		},
+		time.Hour,
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+	joined.With(OptionMaxPending(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startOrders(ctx)
+	startPayments(ctx)
+
+	for _, name := range []string{"a", "b", "c"} {
+		orders <- &kv{name: name}
+	}
+
+	select {
+	case out := <-expired.Output():
+		if out.Left == nil || (*out.Left).name != "a" {
+			b.Errorf("expected the oldest payload to be evicted %v", out)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for evicted payload")
+		b.FailNow()
+	}
+
+	payments <- "c"
+
+	select {
+	case out := <-joined.Output():
+		if out != "c:c" {
+			b.Errorf("unexpected join %v", out)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for join")
+	}
+}
@@ -0,0 +1,192 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Parallel is a function for applying fnA and fnB to each payload concurrently and combining
+// the results once both have returned. Payloads that do not have both results within the
+// timeout, including those where fnA or fnB panicked, are sent to the timedOut branch. Both
+// functions receive the same payload, so neither should modify it. When the context is
+// cancelled the payloads waiting on a result are sent to the flush function. Like Transform
+// it cannot be used inside a loop.
+func Parallel[T, A, B, O any](
+	m Machine[T],
+	fnA func(d T) A,
+	fnB func(d T) B,
+	combine func(a A, b B) O,
+	timeout time.Duration,
+) (combined Machine[O], timedOut Machine[T], err error) {
+	x := m.(*builder[T])
+
+	if x.loop != nil {
+		return nil, nil, fmt.Errorf("parallel cannot be used in a loop")
+	} else if timeout <= 0 {
+		return nil, nil, fmt.Errorf("parallel timeout must be greater than 0")
+	}
+
+	name := x.name + ":" + "parallel"
+	n := x.attach("parallel", name, map[string]string{
+		"timeout": timeout.String(),
+	})
+	stage := n.stage
+
+	left := child[T, O](x, n, name, "", nil)
+	right := child[T, T](x, n, name+":timeout", "timeout", nil)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		left.setup(ctx)
+		right.setup(ctx)
+
+		g := &gather[T, A, B, O]{
+			combine: combine,
+			timeout: timeout,
+			pending: map[uint64]*gathered[T, A, B]{},
+		}
+		chA := make(chan correlated[T], stage.bufferSize)
+		chB := make(chan correlated[T], stage.bufferSize)
+
+		// the payloads held by fnA and fnB are pending in the gather, so only the
+		// sweep flushes them
+		inner := stage.untimed()
+		inner.flushFN, inner.typedFlush = nil, nil
+
+		vertex[correlated[T]](func(ctx context.Context, payload correlated[T]) {
+			if out, ok := g.setA(payload.id, fnA(payload.data)); ok {
+				send(ctx, left.output, out)
+			}
+		}).run(ctx, name+":a", chA, inner)
+
+		vertex[correlated[T]](func(ctx context.Context, payload correlated[T]) {
+			if out, ok := g.setB(payload.id, fnB(payload.data)); ok {
+				send(ctx, left.output, out)
+			}
+		}).run(ctx, name+":b", chB, inner)
+
+		vertex[T](func(ctx context.Context, payload T) {
+			c := g.add(payload)
+			send(ctx, chA, c)
+			send(ctx, chB, c)
+		}).run(ctx, name, channel, stage.untimed())
+
+		spawn(ctx, func() { g.sweep(ctx, stage.vertexName(name), right.output, stage) })
+	}
+
+	return left, right, nil
+}
+
+// correlated is a payload tagged with the id used to match the results of Parallel
+type correlated[T any] struct {
+	id   uint64
+	data T
+}
+
+type gathered[T, A, B any] struct {
+	data     T
+	deadline time.Time
+	a        A
+	b        B
+	hasA     bool
+	hasB     bool
+}
+
+type gather[T, A, B, O any] struct {
+	combine func(a A, b B) O
+	timeout time.Duration
+	seq     atomic.Uint64
+	m       sync.Mutex
+	pending map[uint64]*gathered[T, A, B]
+}
+
+func (g *gather[T, A, B, O]) add(data T) correlated[T] {
+	id := g.seq.Add(1)
+
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	g.pending[id] = &gathered[T, A, B]{data: data, deadline: time.Now().Add(g.timeout)}
+	return correlated[T]{id: id, data: data}
+}
+
+func (g *gather[T, A, B, O]) setA(id uint64, a A) (O, bool) {
+	return g.set(id, func(e *gathered[T, A, B]) { e.a, e.hasA = a, true })
+}
+
+func (g *gather[T, A, B, O]) setB(id uint64, b B) (O, bool) {
+	return g.set(id, func(e *gathered[T, A, B]) { e.b, e.hasB = b, true })
+}
+
+// set records a result and combines the results once both are present, results for
+// payloads that have already timed out are discarded.
+func (g *gather[T, A, B, O]) set(id uint64, fn func(e *gathered[T, A, B])) (O, bool) {
+	var out O
+
+	g.m.Lock()
+	e, ok := g.pending[id]
+	if ok {
+		fn(e)
+		if ok = e.hasA && e.hasB; ok {
+			delete(g.pending, id)
+		}
+	}
+	g.m.Unlock()
+
+	if ok {
+		out = g.combine(e.a, e.b)
+	}
+
+	return out, ok
+}
+
+// sweep sends the payloads that have timed out to the output until the context is
+// done, then sends the payloads still pending to the flush function.
+func (g *gather[T, A, B, O]) sweep(ctx context.Context, vertexName string, output chan T, option *config) {
+	ticker := time.NewTicker(max(g.timeout/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if f := flusher[T](vertexName, option); f != nil {
+				flush(vertexName, nil, g.expire(time.Time{}), f, nil)
+			}
+			return
+		case now := <-ticker.C:
+			for _, data := range g.expire(now) {
+				send(ctx, output, data)
+			}
+		}
+	}
+}
+
+// expire removes the payloads with a deadline at or before now, or all of them if
+// now is zero, and returns them in the order they were received.
+func (g *gather[T, A, B, O]) expire(now time.Time) []T {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	ids := []uint64{}
+	for id, e := range g.pending {
+		if now.IsZero() || !e.deadline.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	out := make([]T, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, g.pending[id].data)
+		delete(g.pending, id)
+	}
+
+	return out
+}
@@ -0,0 +1,145 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Parallel(b *testing.T) {
+	count := 1000
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	combined, timedOut, err := Parallel(m,
+		func(d *kv) string {
+			return d.name
+		},
+		func(d *kv) int {
+			if d.value < 0 {
+				<-time.After(time.Second)
+			}
+			return d.value
+		},
+		func(a string, b int) string {
+			return a + ":" + strconv.Itoa(b)
+		},
+		50*time.Millisecond,
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: strconv.Itoa(n), value: n}
+		}
+		channel <- &kv{name: "slow", value: -1}
+	}()
+
+	for n := 0; n < count; n++ {
+		select {
+		case out := <-combined.Output():
+			if out[:len(out)/2] != out[len(out)/2+1:] {
+				b.Errorf("unexpected result %v", out)
+			}
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for result %v", n)
+			b.FailNow()
+		}
+	}
+
+	select {
+	case d := <-timedOut.Output():
+		if d.name != "slow" {
+			b.Errorf("unexpected timed out payload %v", d)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for timed out payload")
+	}
+}
+
+func Test_Parallel_Flush(b *testing.T) {
+	channel := make(chan int)
+	release := make(chan struct{})
+	m := sync.Mutex{}
+	flushed := map[string]int{}
+
+	r, start := NewRunner("machine_id",
+		channel,
+		OptionFIF0,
+		OptionBufferSize(10),
+		OptionFlush(10*time.Millisecond, func(vertexName string, payload any) {
+			m.Lock()
+			defer m.Unlock()
+
+			d, ok := payload.(int)
+			if !ok {
+				b.Errorf("unexpected flushed payload %T from %s", payload, vertexName)
+				return
+			}
+			flushed[strconv.Itoa(d)]++
+		}),
+	)
+
+	combined, _, err := Parallel(start,
+		func(d int) int {
+			<-release
+			return d
+		},
+		func(d int) int {
+			<-release
+			return d
+		},
+		func(a, b int) int {
+			return a + b
+		},
+		time.Hour,
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+	combined.Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_ = r.Start(ctx)
+
+	for n := 0; n < 3; n++ {
+		channel <- n
+	}
+
+	<-time.After(10 * time.Millisecond)
+	cancel()
+	close(release)
+	_ = r.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+
+	for key, count := range flushed {
+		if count > 1 {
+			b.Errorf("payload %s flushed %d times", key, count)
+		}
+	}
+
+	// the first payload is held by fnA and fnB, it is only flushed if the sweep
+	// exits before they return
+	if flushed["1"] != 1 || flushed["2"] != 1 {
+		b.Errorf("expected the pending payloads to be flushed got %v", flushed)
+	}
+}
@@ -0,0 +1,181 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrNotStarted is returned by a Runner that has not been started
+	ErrNotStarted = errors.New("machine: runner has not been started")
+	// ErrAlreadyStarted is returned when Start is called more than once
+	ErrAlreadyStarted = errors.New("machine: runner has already been started")
+	// ErrNoVertices is returned when Start is called on a Machine without any vertices
+	ErrNoVertices = errors.New("machine: machine has no vertices")
+)
+
+// Runner controls the lifecycle of a Machine, it tracks every goroutine started
+// by the Machine so that it can be shutdown deterministically.
+type Runner interface {
+	// Start starts the Machine, it will run until the context is cancelled or Stop is called.
+	Start(ctx context.Context) error
+	// Stop cancels the Machine and waits for every goroutine to exit, including any flush,
+	// or for the context to be done.
+	Stop(ctx context.Context) error
+	// Wait blocks until every goroutine has exited and returns the first panic recovered
+	// while running, if any.
+	Wait() error
+	// Done is closed once every goroutine has exited.
+	Done() <-chan struct{}
+}
+
+type runner struct {
+	m      sync.Mutex
+	start  func(ctx context.Context) error
+	cancel context.CancelFunc
+	life   *lifecycle
+	done   chan struct{}
+}
+
+// lifecycle is stored in the context of a running Machine to track its goroutines
+type lifecycle struct {
+	wg  sync.WaitGroup
+	m   sync.Mutex
+	err error
+}
+
+// NewRunner is a function for creating a new Machine along with the Runner used to control it.
+//
+// name string
+// input chan T
+// option ...Option
+//
+// Call Start on the Runner to start the Machine once built.
+func NewRunner[T any](name string, input chan T, options ...Option) (Runner, Machine[T]) {
+	b := root(name, input, options...)
+
+	return &runner{
+		start: func(ctx context.Context) error {
+			if b.start == nil {
+				return ErrNoVertices
+			}
+
+			if b.option.drainPeriod > 0 {
+				runDrained(ctx, b, input)
+			} else {
+				b.start(ctx, input)
+			}
+
+			return nil
+		},
+		life: &lifecycle{},
+		done: make(chan struct{}),
+	}, b
+}
+
+// Start starts the Machine, it will run until the context is cancelled or Stop is called.
+func (r *runner) Start(ctx context.Context) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.cancel != nil {
+		return ErrAlreadyStarted
+	}
+
+	c, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+
+	r.life.wg.Add(1)
+	defer r.life.wg.Done()
+
+	go func() {
+		<-c.Done()
+		r.life.wg.Wait()
+		close(r.done)
+	}()
+
+	if err := r.start(context.WithValue(c, lifecycleKey, r.life)); err != nil {
+		cancel()
+		return err
+	}
+
+	return nil
+}
+
+// Stop cancels the Machine and waits for every goroutine to exit, including any flush,
+// or for the context to be done.
+func (r *runner) Stop(ctx context.Context) error {
+	r.m.Lock()
+	cancel := r.cancel
+	r.m.Unlock()
+
+	if cancel == nil {
+		return ErrNotStarted
+	}
+
+	cancel()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return nil
+	}
+}
+
+// Wait blocks until every goroutine has exited and returns the first panic recovered
+// while running, if any.
+func (r *runner) Wait() error {
+	r.m.Lock()
+	started := r.cancel != nil
+	r.m.Unlock()
+
+	if !started {
+		return ErrNotStarted
+	}
+
+	<-r.done
+
+	return r.life.failure()
+}
+
+// Done is closed once every goroutine has exited.
+func (r *runner) Done() <-chan struct{} {
+	return r.done
+}
+
+func (l *lifecycle) fail(err error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.err == nil {
+		l.err = err
+	}
+}
+
+func (l *lifecycle) failure() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.err
+}
+
+// spawn starts fn in a goroutine tracked by the lifecycle in the context, if there is one
+func spawn(ctx context.Context, fn func()) {
+	l, ok := ctx.Value(lifecycleKey).(*lifecycle)
+	if !ok {
+		go fn()
+		return
+	}
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		fn()
+	}()
+}
@@ -0,0 +1,207 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Runner(b *testing.T) {
+	channel := make(chan *kv)
+	r, m := NewRunner("machine_id",
+		channel,
+		OptionBufferSize(10),
+	)
+
+	if err := r.Wait(); !errors.Is(err, ErrNotStarted) {
+		b.Errorf("expected ErrNotStarted got %v", err)
+	}
+
+	left, right := m.If(func(d *kv) bool {
+		return d.value > 0
+	})
+
+	left.Then(
+		func(d *kv) *kv {
+			panic("boom")
+		},
+	)
+
+	out := right.Output()
+
+	if err := r.Start(context.Background()); err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	if err := r.Start(context.Background()); !errors.Is(err, ErrAlreadyStarted) {
+		b.Errorf("expected ErrAlreadyStarted got %v", err)
+	}
+
+	// nobody reads the output channel after this, the vertices must still exit on Stop
+	for n := 0; n < 20; n++ {
+		channel <- &kv{name: "data", value: n % 2}
+	}
+	<-out
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := r.Stop(ctx); err != nil {
+		b.Error(err)
+	}
+
+	select {
+	case <-r.Done():
+	default:
+		b.Errorf("expected Done to be closed")
+	}
+
+	var p *PanicError
+	if err := r.Wait(); !errors.As(err, &p) || p.Value != "boom" {
+		b.Errorf("expected panic error got %v", err)
+	}
+}
+
+func Test_Runner_NoVertices(b *testing.T) {
+	r, _ := NewRunner("machine_id", make(chan *kv))
+
+	if err := r.Start(context.Background()); !errors.Is(err, ErrNoVertices) {
+		b.Errorf("expected ErrNoVertices got %v", err)
+	}
+
+	<-r.Done()
+}
+
+func Test_Drain(b *testing.T) {
+	count := 50
+	channel := make(chan *kv)
+	reports := make(chan DrainReport, 1)
+	r, m := NewRunner("machine_id",
+		channel,
+		OptionFIF0,
+		OptionBufferSize(count),
+		OptionFlush(10*time.Millisecond, func(string, any) {
+			b.Errorf("nothing should be flushed")
+		}),
+		OptionDrain(time.Second, func(report DrainReport) {
+			reports <- report
+		}),
+	)
+
+	out := m.
+		Then(
+			func(d *kv) *kv {
+				<-time.After(time.Millisecond)
+				return d
+			},
+		).
+		Then(
+			func(d *kv) *kv {
+				return d
+			},
+		).Output()
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range out {
+			n++
+			if n == count {
+				received <- n
+			}
+		}
+	}()
+
+	if err := r.Start(context.Background()); err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	for n := 0; n < count; n++ {
+		channel <- deepcopy(testPayloadBase)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := r.Stop(ctx); err != nil {
+		b.Error(err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		b.Errorf("accepted payloads were not drained")
+	}
+
+	report := <-reports
+	if s := report["machine_id:then"]; s.Drained == 0 || s.Flushed != 0 {
+		b.Errorf("unexpected report %v", report)
+	}
+}
+
+func Test_Drain_Input(b *testing.T) {
+	count := 100
+	channel := make(chan *kv, count)
+	reports := make(chan DrainReport, 1)
+	flushed := &atomic.Int64{}
+	r, m := NewRunner("machine_id",
+		channel,
+		OptionFIF0,
+		OptionFlush(50*time.Millisecond, func(string, any) {
+			flushed.Add(1)
+		}),
+		OptionDrain(20*time.Millisecond, func(report DrainReport) {
+			reports <- report
+		}),
+	)
+
+	out := m.Then(
+		func(d *kv) *kv {
+			<-time.After(5 * time.Millisecond)
+			return d
+		},
+	).Output()
+
+	received := &atomic.Int64{}
+	go func() {
+		for range out {
+			received.Add(1)
+		}
+	}()
+
+	for n := 0; n < count; n++ {
+		channel <- deepcopy(testPayloadBase)
+	}
+
+	if err := r.Start(context.Background()); err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	<-time.After(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := r.Stop(ctx); err != nil {
+		b.Error(err)
+	}
+
+	report := <-reports
+	if report["machine_id"].Flushed == 0 {
+		b.Errorf("expected the input to be flushed %v", report)
+	}
+
+	if n := received.Load() + flushed.Load(); n != int64(count) || len(channel) != 0 {
+		b.Errorf("expected every payload to be received or flushed got %d with %d left", n, len(channel))
+	}
+}
@@ -0,0 +1,239 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StateStore holds the state of a Stateful stage by key. Implementations must be safe
+// for concurrent use, Stateful ensures that a key is only used by one payload at a time.
+type StateStore[S any] interface {
+	// Load returns the state for the key and whether it was found.
+	Load(key string) (S, bool, error)
+	// Store sets the state for the key.
+	Store(key string, state S) error
+}
+
+// Stateful applies fn to each payload along with the state for the key of the payload,
+// the state returned by fn is saved in the store and the payload returned is sent on. The
+// state starts as the zero value of S. Payloads with the same key are processed one at a
+// time. An error from the store is treated as a panic of the vertex.
+func Stateful[T, S any](m Machine[T], key func(d T) string, store StateStore[S], fn func(state S, d T) (S, T)) Machine[T] {
+	x := m.(*builder[T])
+	locks := &keyLocks{locks: map[string]*keyLock{}}
+
+	return x.component("stateful", func(output chan T) vertex[T] {
+		return func(ctx context.Context, payload T) {
+			send(ctx, output, update(locks, key(payload), store, payload, fn))
+		}
+	})
+}
+
+func update[T, S any](locks *keyLocks, key string, store StateStore[S], payload T, fn func(state S, d T) (S, T)) T {
+	defer locks.lock(key)()
+
+	state, _, err := store.Load(key)
+	if err != nil {
+		panic(err)
+	}
+
+	state, payload = fn(state, payload)
+	if err := store.Store(key, state); err != nil {
+		panic(err)
+	}
+
+	return payload
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// keyLocks is a mutex per key, the mutex is removed once it is no longer in use
+type keyLocks struct {
+	m     sync.Mutex
+	locks map[string]*keyLock
+}
+
+func (l *keyLocks) lock(key string) (unlock func()) {
+	l.m.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.m.Unlock()
+
+	kl.Lock()
+
+	return func() {
+		kl.Unlock()
+
+		l.m.Lock()
+		defer l.m.Unlock()
+
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// MemoryStore is a StateStore that holds the state in memory.
+type MemoryStore[S any] struct {
+	m     sync.RWMutex
+	state map[string]S
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore[S any]() *MemoryStore[S] {
+	return &MemoryStore[S]{state: map[string]S{}}
+}
+
+// Load returns the state for the key and whether it was found.
+func (s *MemoryStore[S]) Load(key string) (S, bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	state, ok := s.state[key]
+	return state, ok, nil
+}
+
+// Store sets the state for the key.
+func (s *MemoryStore[S]) Store(key string, state S) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.state[key] = state
+	return nil
+}
+
+// FileStore is a StateStore that holds the state in memory and appends every change to
+// a local file as a line of JSON, so the state survives restarts. The file is replayed
+// and compacted when the FileStore is opened. S must be able to be encoded as JSON.
+type FileStore[S any] struct {
+	memory *MemoryStore[S]
+	m      sync.Mutex
+	file   *os.File
+}
+
+type fileStoreEntry[S any] struct {
+	Key   string `json:"key"`
+	State S      `json:"state"`
+}
+
+// NewFileStore opens the FileStore at path, creating the file if it does not exist.
+// Call Close once the Machine using it has stopped.
+func NewFileStore[S any](path string) (*FileStore[S], error) {
+	memory := NewMemoryStore[S]()
+
+	if err := replay(path, memory); err != nil {
+		return nil, err
+	}
+
+	if err := compact(path, memory); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore[S]{memory: memory, file: file}, nil
+}
+
+// Load returns the state for the key and whether it was found.
+func (s *FileStore[S]) Load(key string) (S, bool, error) {
+	return s.memory.Load(key)
+}
+
+// Store sets the state for the key and appends it to the file.
+func (s *FileStore[S]) Store(key string, state S) error {
+	line, err := json.Marshal(fileStoreEntry[S]{Key: key, State: state})
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return s.memory.Store(key, state)
+}
+
+// Close closes the file.
+func (s *FileStore[S]) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.file.Close()
+}
+
+func replay[S any](path string, memory *MemoryStore[S]) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// a partial last line is left if the process exits while writing, so an
+	// invalid line is only an error if it is followed by another line
+	var invalid error
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if invalid != nil {
+			return invalid
+		}
+
+		entry := fileStoreEntry[S]{}
+		if invalid = json.Unmarshal(scanner.Bytes(), &entry); invalid == nil {
+			memory.state[entry.Key] = entry.State
+		}
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the file with a single line per key
+func compact[S any](path string, memory *MemoryStore[S]) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for key, state := range memory.state {
+		if err := encoder.Encode(fileStoreEntry[S]{Key: key, State: state}); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	} else if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
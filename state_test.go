@@ -0,0 +1,156 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Stateful(b *testing.T) {
+	count := 1000
+	keys := 10
+	channel := make(chan *kv)
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- &kv{name: strconv.Itoa(n % keys), value: 1}
+		}
+	}()
+
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	store := NewMemoryStore[int]()
+
+	out := Stateful(m,
+		func(d *kv) string {
+			return d.name
+		},
+		store,
+		func(state int, d *kv) (int, *kv) {
+			state += d.value
+			d.value = state
+			return state, d
+		},
+	).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	for n := 0; n < count; n++ {
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for payload %v", n)
+			b.FailNow()
+		}
+	}
+
+	for n := 0; n < keys; n++ {
+		if state, ok, _ := store.Load(strconv.Itoa(n)); !ok || state != count/keys {
+			b.Errorf("unexpected state %v for key %v", state, n)
+		}
+	}
+}
+
+type failingStore struct {
+	*MemoryStore[int]
+}
+
+func (s failingStore) Store(key string, state int) error {
+	return errors.New("unavailable")
+}
+
+func Test_Stateful_Error(b *testing.T) {
+	channel := make(chan *kv)
+	deadLetters := &atomic.Int64{}
+	startFn, m := New("machine_id",
+		channel,
+		OptionDeadLetter(func(vertexName string, payload any, err error) {
+			if err.Error() == "panic in machine_id:stateful: unavailable" {
+				deadLetters.Add(1)
+			}
+		}),
+	)
+
+	Stateful(m,
+		func(d *kv) string {
+			return d.name
+		},
+		StateStore[int](failingStore{NewMemoryStore[int]()}),
+		func(state int, d *kv) (int, *kv) {
+			return state + 1, d
+		},
+	).Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	channel <- deepcopy(testPayloadBase)
+	channel <- deepcopy(testPayloadBase)
+
+	<-time.After(50 * time.Millisecond)
+
+	if deadLetters.Load() != 2 {
+		b.Errorf("expected store errors to be dead lettered %v", deadLetters.Load())
+	}
+}
+
+func Test_FileStore(b *testing.T) {
+	path := filepath.Join(b.TempDir(), "state.jsonl")
+
+	store, err := NewFileStore[map[string]int](path)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	for n := 0; n < 10; n++ {
+		if err := store.Store("a", map[string]int{"count": n}); err != nil {
+			b.Error(err)
+		}
+	}
+
+	if err := store.Store("b", map[string]int{"count": 1}); err != nil {
+		b.Error(err)
+	}
+
+	if err := store.Close(); err != nil {
+		b.Error(err)
+	}
+
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	_, _ = f.WriteString(`{"key":"b","sta`)
+	_ = f.Close()
+
+	store, err = NewFileStore[map[string]int](path)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+	defer store.Close()
+
+	if state, ok, _ := store.Load("a"); !ok || state["count"] != 9 {
+		b.Errorf("unexpected state %v", state)
+	}
+
+	if state, ok, _ := store.Load("b"); !ok || state["count"] != 1 {
+		b.Errorf("unexpected state %v", state)
+	}
+
+	if data, _ := os.ReadFile(path); len(data) == 0 || len(data) > 64 {
+		b.Errorf("expected file to be compacted %s", data)
+	}
+}
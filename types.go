@@ -6,7 +6,12 @@ package machine
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/whitaker-io/machine/common"
@@ -18,6 +23,57 @@ type Monad[T any] func(d T) T
 // Filter is a function that can be used to filter the data.
 type Filter[T any] func(d T) bool
 
+// Failure is the envelope sent to the failed branch of Try, it carries the name
+// of the vertex that failed, the original payload and the error that was returned.
+type Failure[T any] struct {
+	Vertex  string
+	Payload T
+	Err     error
+}
+
+// Error implements the error interface
+func (f Failure[T]) Error() string {
+	return fmt.Sprintf("%s: %v", f.Vertex, f.Err)
+}
+
+// Unwrap returns the underlying error
+func (f Failure[T]) Unwrap() error {
+	return f.Err
+}
+
+// PanicError wraps the value recovered from a panicking vertex, it is attached to the
+// trace event and passed to the dead letter function.
+type PanicError struct {
+	// Vertex is the name of the vertex that panicked
+	Vertex string
+	// Value is the recovered value, which may or may not be an error
+	Value any
+	// Stack is the stack trace captured when the panic was recovered
+	Stack []byte
+	// PayloadType is the type of the payload being processed
+	PayloadType string
+}
+
+// Error implements the error interface
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", p.Vertex, p.Value)
+}
+
+// Unwrap returns the recovered value if it is an error
+func (p *PanicError) Unwrap() error {
+	err, _ := p.Value.(error)
+	return err
+}
+
+var (
+	// ErrMaxDepth is passed to the dead letter function for payloads that exceed OptionMaxDepth
+	ErrMaxDepth = errors.New("machine: max recursion depth exceeded")
+	// ErrMaxIterations is passed to the dead letter function for payloads that exceed OptionMaxIterations
+	ErrMaxIterations = errors.New("machine: max loop iterations exceeded")
+	// ErrTimeout is passed to the dead letter function for payloads that exceed OptionTimeout
+	ErrTimeout = errors.New("machine: vertex timed out")
+)
+
 // Edge is an interface that is used for transferring data between vertices
 type Edge[T any] interface {
 	Output() chan T
@@ -50,24 +106,208 @@ func OptionBufferSize(size int) Option {
 }
 
 // OptionAttributes apply the slog.Attr's to the machine metrics and spans
-// Do not override the "name", "type", "duration", "error", or "value" attributes
+// Do not override the "name", "path", "type", "duration", "error", or "value" attributes
 func OptionAttributes(attributes ...slog.Attr) Option {
 	return &option{func(c *config) { c.attributes = attributes }}
 }
 
 // OptionFlush attempts to send all data to the flushFN before exiting after the gracePeriod has expired
-// Im looking for a good way to make this type specific, but want to avoid having to add separate option
-// settings for the Transform function.
+// Use OnFlush for a type specific flush function.
 func OptionFlush(gracePeriod time.Duration, flushFN func(vertexName string, payload any)) Option {
 	return &option{func(c *config) { c.flushFN = flushFN; c.gracePeriod = gracePeriod }}
 }
 
+// OptionDeadLetter sets a function that receives every payload whose vertex panicked, including
+// panics inside of Edge.Send, along with a *PanicError holding the panic value and stack trace.
+func OptionDeadLetter(deadLetterFN func(vertexName string, payload any, err error)) Option {
+	return &option{func(c *config) { c.deadLetterFN = deadLetterFN }}
+}
+
+// OptionOrdered processes up to n payloads concurrently while emitting the results
+// to the output channels in the order the payloads were received. Edge.Send is
+// called in order as well, so Distribute stages are serialized. Ignored when
+// OptionFIF0 is set.
+func OptionOrdered(n int) Option {
+	return &option{func(c *config) { c.ordered = n }}
+}
+
+// OptionConcurrency runs each vertex with a fixed pool of n workers pulling from its
+// channel instead of starting a goroutine per payload, this provides backpressure
+// while still processing in parallel. Ignored when OptionFIF0 is set.
+func OptionConcurrency(n int) Option {
+	return &option{func(c *config) { c.concurrency = n }}
+}
+
+// OptionMaxPending limits the number of payloads a Join holds waiting for a match to n,
+// once it is reached the oldest payloads are expired early to make room for new ones.
+func OptionMaxPending(n int) Option {
+	return &option{func(c *config) { c.maxPending = n }}
+}
+
+// OptionMaxDepth limits the recursion of Recurse, Memoize and MemoizeShared to a depth of n
+// per payload. Payloads that exceed it are not sent on, they are passed to the OptionDeadLetter
+// function with ErrMaxDepth and counted by the machine.loop.exceeded metric.
+func OptionMaxDepth(n int) Option {
+	return &option{func(c *config) { c.maxDepth = n }}
+}
+
+// OptionMaxIterations limits the number of times a payload can go around a While or
+// WhileTransform loop to n. Payloads are told apart by the key function, which must return
+// the same key for a payload every time it comes back around and a different key for every
+// other payload inside the loop. Payloads that exceed it are not sent on, they are passed to
+// the OptionDeadLetter function with ErrMaxIterations and counted by the machine.loop.exceeded
+// metric. Loops whose payload is not of type T ignore it.
+func OptionMaxIterations[T any](n int, key func(d T) string) Option {
+	return &option{func(c *config) {
+		c.maxIter = n
+		c.iterKey = key
+	}}
+}
+
+// OptionTimeout sets a deadline of d on the context passed to every Monad, Filter or
+// Edge.Send invocation of the vertex. At the deadline the payload is given up on, unless it
+// has already been sent on or passed to Edge.Send, and the vertex moves on to the next one
+// while the function that is still running is left to return on its own, without sending the
+// payload on or reporting a panic. Payloads that miss the deadline are recorded as a span event,
+// counted by the machine.timeouts metric and sent to the branch set by OnTimeout, or passed to
+// the OptionDeadLetter function with ErrTimeout if there is none. The vertices internal to
+// Window, Batch, Join and Parallel ignore it.
+func OptionTimeout(d time.Duration) Option {
+	return &option{func(c *config) { c.timeout = d }}
+}
+
 type config struct {
-	fifo        bool
-	bufferSize  int
-	attributes  []slog.Attr
-	gracePeriod time.Duration
-	flushFN     func(vertexName string, payload any)
+	fifo         bool
+	concurrency  int
+	ordered      int
+	bufferSize   int
+	attributes   []slog.Attr
+	gracePeriod  time.Duration
+	flushFN      func(vertexName string, payload any)
+	typedFlush   any
+	partition    any
+	deadLetterFN func(vertexName string, payload any, err error)
+	name         string
+	drainPeriod  time.Duration
+	drainFN      func(DrainReport)
+	maxPending   int
+	maxDepth     int
+	maxIter      int
+	iterKey      any
+	timeout      time.Duration
+	timedOut     any
+}
+
+func (c *config) clone() *config {
+	out := *c
+	return &out
+}
+
+// untimed returns a copy of the config without OptionTimeout, for the vertices that are
+// internal to a stage rather than running a Monad, Filter or Edge.Send
+func (c *config) untimed() *config {
+	out := c.clone()
+	out.timeout = 0
+	return out
+}
+
+// describe returns the settings of the config for the Graph
+func (c *config) describe() map[string]string {
+	out := map[string]string{}
+
+	if c.fifo {
+		out["fifo"] = strconv.FormatBool(c.fifo)
+	}
+	if c.ordered > 0 {
+		out["ordered"] = strconv.Itoa(c.ordered)
+	}
+	if c.concurrency > 0 {
+		out["concurrency"] = strconv.Itoa(c.concurrency)
+	}
+	if c.bufferSize > 0 {
+		out["buffer"] = strconv.Itoa(c.bufferSize)
+	}
+	if c.flushFN != nil {
+		out["flush"] = c.gracePeriod.String()
+	}
+	if f, ok := c.typedFlush.(interface{ period() time.Duration }); ok {
+		out["flush"] = f.period().String()
+	}
+	if c.maxPending > 0 {
+		out["max_pending"] = strconv.Itoa(c.maxPending)
+	}
+	if c.maxDepth > 0 {
+		out["max_depth"] = strconv.Itoa(c.maxDepth)
+	}
+	if c.maxIter > 0 {
+		out["max_iterations"] = strconv.Itoa(c.maxIter)
+	}
+	if c.timeout > 0 {
+		out["timeout"] = c.timeout.String()
+	}
+	if p, ok := c.partition.(interface{ size() int }); ok {
+		out["partition"] = strconv.Itoa(p.size())
+	}
+
+	return out
+}
+
+// vertexName returns the name set through Named or the path of the vertex
+func (c *config) vertexName(path string) string {
+	if c.name != "" {
+		return c.name
+	}
+
+	return path
+}
+
+// labels are the attributes attached to the metrics and spans of a vertex
+type labels []slog.Attr
+
+// labels returns the attributes of the vertex at the path
+func (c *config) labels(path string) labels {
+	return labels{slog.String("name", c.vertexName(path)), slog.String("path", path)}.with(c.attributes...)
+}
+
+func (l labels) with(attrs ...slog.Attr) labels {
+	out := make(labels, 0, len(l)+len(attrs))
+	return append(append(out, l...), attrs...)
+}
+
+type ctxKey int
+
+const (
+	turnKey ctxKey = iota
+	lifecycleKey
+	drainKey
+	deadlineKey
+)
+
+const (
+	payloadPending int32 = iota
+	payloadSending
+	payloadSent
+	payloadExpired
+)
+
+// deadline decides between a vertex sending the payload on and OptionTimeout giving up on it,
+// so that a payload is never both sent on and reported as timed out.
+type deadline struct {
+	state atomic.Int32
+	// late is set when the vertex returned after a send was cut short by the deadline
+	late bool
+}
+
+// turn is used by ordered vertices to wait for the previous payload to be
+// emitted before emitting the current one.
+type turn struct {
+	prev chan struct{}
+	done chan struct{}
+}
+
+type orderedJob[T any] struct {
+	turn *turn
+	data T
 }
 
 type vertex[T any] func(ctx context.Context, data T)
@@ -80,7 +320,7 @@ type filterList[T any] []Filter[T]
 type filterComponent[T any] func(left, right chan T) vertex[T]
 
 func (x Monad[T]) component(output chan T) vertex[T] {
-	return func(_ context.Context, data T) { output <- x(data) }
+	return func(ctx context.Context, data T) { send(ctx, output, x(data)) }
 }
 func (x monadList[T]) combine() Monad[T] {
 	if len(x) == 1 {
@@ -113,16 +353,16 @@ func (x filterList[T]) and() Filter[T] {
 }
 
 func (x Filter[T]) component(left, right chan T) vertex[T] {
-	return func(_ context.Context, data T) {
+	return func(ctx context.Context, data T) {
 		if x(data) {
-			left <- data
+			send(ctx, left, data)
 		} else {
-			right <- data
+			send(ctx, right, data)
 		}
 	}
 }
 
-func (x vertex[T]) wrap(name string) vertex[T] {
+func (x vertex[T]) wrap(name string, attrs labels, option *config) vertex[T] {
 	return func(ctx context.Context, data T) {
 		start := time.Now()
 
@@ -132,40 +372,319 @@ func (x vertex[T]) wrap(name string) vertex[T] {
 			c,
 			common.LevelTrace,
 			name,
-			slog.String("type", common.TraceStart),
+			attrs.with(slog.String("type", common.TraceStart))...,
 		)
 
 		slog.LogAttrs(
 			c,
 			common.LevelMetric,
 			"machine.runs",
-			slog.String("name", name),
-			slog.String("type", common.MetricInt64Counter),
-			slog.Int64("value", 1),
+			attrs.with(
+				slog.String("type", common.MetricInt64Counter),
+				slog.Int64("value", 1),
+			)...,
+		)
+
+		run := func(c context.Context) {
+			defer recoverFn(c, name, attrs, start, data, option)
+			x(c, data)
+		}
+
+		if option.timeout > 0 {
+			timed(c, option.timeout, run, func() { timeoutFn(c, name, attrs, data, option) })
+		} else {
+			run(c)
+		}
+	}
+}
+
+// timed runs fn behind the deadline of OptionTimeout. At the deadline the payload is given up
+// on and expired is called, unless fn has started sending it on. fn is left to return on its
+// own, so that it no longer holds up the vertex.
+func timed(ctx context.Context, timeout time.Duration, fn func(ctx context.Context), expired func()) {
+	d := &deadline{}
+	c, cancel := context.WithTimeoutCause(context.WithValue(ctx, deadlineKey, d), timeout, ErrTimeout)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		fn(c)
+		if d.late {
+			expired()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-c.Done():
+		if !errors.Is(context.Cause(c), ErrTimeout) {
+			<-done
+		} else if d.state.CompareAndSwap(payloadPending, payloadExpired) {
+			expired()
+		}
+	}
+}
+
+func (x vertex[T]) run(ctx context.Context, path string, channel chan T, option *config) {
+	name := option.vertexName(path)
+	attrs := option.labels(path)
+	h := x.wrap(name, attrs, option)
+
+	_, partitioned := option.partition.(*partitioner[T])
+
+	switch {
+	case partitioned:
+		h.partition(ctx, name, attrs, channel, option)
+	case option.fifo:
+		spawn(ctx, func() { transfer(ctx, channel, h, name, option) })
+	case option.ordered > 0:
+		h.ordered(ctx, name, channel, option)
+	case option.concurrency > 0:
+		h.pool(ctx, name, attrs, channel, option)
+	default:
+		spawn(ctx, func() {
+			transfer(ctx, channel, func(ctx context.Context, data T) {
+				d := drainFrom(ctx)
+				d.add(1)
+				spawn(ctx, func() {
+					defer d.add(-1)
+					h(ctx, data)
+				})
+			}, name, option)
+		})
+	}
+}
+
+func (x vertex[T]) pool(ctx context.Context, name string, attrs labels, channel chan T, option *config) {
+	busy := &atomic.Int64{}
+
+	worker := func(ctx context.Context, data T) {
+		slog.LogAttrs(
+			ctx,
+			common.LevelMetric,
+			"machine.queue.depth",
+			attrs.with(
+				slog.String("type", common.MetricInt64Histogram),
+				slog.Int64("value", int64(len(channel))),
+			)...,
 		)
+		slog.LogAttrs(
+			ctx,
+			common.LevelMetric,
+			"machine.workers.busy",
+			attrs.with(
+				slog.String("type", common.MetricInt64Histogram),
+				slog.Int64("value", busy.Add(1)),
+			)...,
+		)
+		defer busy.Add(-1)
+
+		x(ctx, data)
+	}
+
+	for i := 0; i < option.concurrency; i++ {
+		spawn(ctx, func() { transfer(ctx, channel, worker, name, option) })
+	}
+}
+
+func (x vertex[T]) ordered(ctx context.Context, name string, channel chan T, option *config) {
+	jobs := make(chan orderedJob[T])
+	last := make(chan struct{})
+	close(last)
+
+	for i := 0; i < option.ordered; i++ {
+		spawn(ctx, func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-jobs:
+					c := context.WithValue(ctx, turnKey, job.turn)
+					x(c, job.data)
+					await(c)
+					close(job.turn.done)
+					drainFrom(ctx).add(-1)
+				}
+			}
+		})
+	}
+
+	spawn(ctx, func() {
+		transfer(ctx, channel,
+			func(ctx context.Context, data T) {
+				t := &turn{prev: last, done: make(chan struct{})}
+				last = t.done
+
+				d := drainFrom(ctx)
+				d.add(1)
+				select {
+				case <-ctx.Done():
+					d.add(-1)
+				case jobs <- orderedJob[T]{turn: t, data: data}:
+				}
+			},
+			name,
+			option,
+		)
+	})
+}
+
+func (x vertex[T]) partition(ctx context.Context, name string, attrs labels, channel chan T, option *config) {
+	p := option.partition.(*partitioner[T])
+	d := drainFrom(ctx)
+	lanes := make([]chan T, p.shards)
+
+	for i := range lanes {
+		lane := make(chan T, option.bufferSize)
+		lanes[i] = lane
+		laneAttrs := attrs.with(slog.Int("shard", i))
+
+		spawn(ctx, func() {
+			for {
+				select {
+				case <-ctx.Done():
+					if f := flusher[T](name, option); f != nil {
+						flush(name, lane, nil, f, d)
+					}
+					return
+				case data := <-lane:
+					slog.LogAttrs(
+						ctx,
+						common.LevelMetric,
+						"machine.queue.depth",
+						laneAttrs.with(
+							slog.String("type", common.MetricInt64Histogram),
+							slog.Int64("value", int64(len(lane))),
+						)...,
+					)
+					x(ctx, data)
+					d.add(-1)
+				}
+			}
+		})
+	}
+
+	// the lanes run the wrapped vertex, so the dispatch is only wrapped when the key
+	// function panics in order to report the panic like any other
+	failed := vertex[T](func(ctx context.Context, data T) {
+		lane := lanes[p.shard(data)]
+		d.add(1)
+		send(ctx, lane, data)
+	}).wrap(name, attrs.with(slog.String("partition", "dispatch")), option)
+
+	spawn(ctx, func() {
+		transfer(ctx, channel, func(ctx context.Context, data T) {
+			if i, ok := p.tryShard(data); ok {
+				d.add(1)
+				send(ctx, lanes[i], data)
+			} else {
+				failed(ctx, data)
+			}
+		}, name, option)
+	})
+}
+
+// await blocks until it is the turn of the payload in an ordered vertex
+func await(ctx context.Context) {
+	if t, ok := ctx.Value(turnKey).(*turn); ok {
+		select {
+		case <-ctx.Done():
+		case <-t.prev:
+		}
+	}
+}
+
+// send waits for the turn of the payload and sends it to the channel, giving up
+// if the context is done so that the vertex can exit.
+func send[T any](ctx context.Context, channel chan T, data T) {
+	await(ctx)
+
+	d := deadlineFrom(ctx)
+	if ctx.Err() != nil || !d.claim() {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case channel <- data:
+		d.sent()
+	}
+}
+
+func deadlineFrom(ctx context.Context) *deadline {
+	d, _ := ctx.Value(deadlineKey).(*deadline)
+	return d
+}
+
+// claim records the vertex starting to send the payload on, it returns false if the
+// payload has already been given up on.
+func (d *deadline) claim() bool {
+	if d == nil {
+		return true
+	}
 
-		defer recoverFn(c, name, start)
+	d.state.CompareAndSwap(payloadPending, payloadSending)
+	return d.state.Load() != payloadExpired
+}
 
-		x(c, data)
+// sent records the payload being sent on
+func (d *deadline) sent() {
+	if d != nil {
+		d.state.CompareAndSwap(payloadSending, payloadSent)
 	}
 }
 
-func (x vertex[T]) run(ctx context.Context, name string, channel chan T, option *config) {
-	h := x.wrap(name)
+// finish records the vertex returning, it returns true if the payload has been given up on.
+// A payload whose send was cut short by the deadline is given up on here, which is reported
+// once the vertex has returned.
+func (d *deadline) finish(ctx context.Context) bool {
+	if d == nil || d.state.CompareAndSwap(payloadPending, payloadSent) {
+		return false
+	}
 
-	if option.fifo {
-		go transfer(ctx, channel, h, name, option)
-	} else {
-		go transfer(ctx, channel, func(ctx context.Context, data T) { go h(ctx, data) }, name, option)
+	if errors.Is(context.Cause(ctx), ErrTimeout) && d.state.CompareAndSwap(payloadSending, payloadExpired) {
+		d.late = true
 	}
+
+	return d.state.Load() == payloadExpired
 }
 
-func recoverFn(ctx context.Context, name string, start time.Time) {
-	var err error
+func timeoutFn[T any](ctx context.Context, name string, attrs labels, data T, option *config) {
+	slog.LogAttrs(
+		ctx,
+		common.LevelTrace,
+		name,
+		slog.String("type", common.TraceEvent),
+		slog.Any("error", ErrTimeout),
+		slog.String("timeout", option.timeout.String()),
+	)
+	slog.LogAttrs(
+		ctx,
+		common.LevelMetric,
+		"machine.timeouts",
+		attrs.with(
+			slog.String("type", common.MetricInt64Counter),
+			slog.Int64("value", 1),
+		)...,
+	)
+
+	if sink, ok := option.timedOut.(timeoutSink[T]); ok {
+		sink(ctx, data)
+	} else if option.deadLetterFN != nil {
+		option.deadLetterFN(name, data, ErrTimeout)
+	}
+}
 
+func recoverFn[T any](ctx context.Context, name string, attrs labels, start time.Time, data T, option *config) {
 	duration := time.Since(start)
-	if r := recover(); r != nil {
-		err, _ = r.(error)
+	r := recover()
+
+	// a payload given up on at the deadline is only reported as the timeout
+	expired := deadlineFrom(ctx).finish(ctx)
+
+	if err, ok := r.(error); !expired && ok && (errors.Is(err, ErrMaxDepth) || errors.Is(err, ErrMaxIterations)) {
 		slog.LogAttrs(
 			ctx,
 			common.LevelTrace,
@@ -173,23 +692,65 @@ func recoverFn(ctx context.Context, name string, start time.Time) {
 			slog.String("type", common.TraceEvent),
 			slog.Any("error", err),
 		)
+		slog.LogAttrs(
+			ctx,
+			common.LevelMetric,
+			"machine.loop.exceeded",
+			attrs.with(
+				slog.String("type", common.MetricInt64Counter),
+				slog.String("error", err.Error()),
+				slog.Int64("value", 1),
+			)...,
+		)
+
+		if option.deadLetterFN != nil {
+			option.deadLetterFN(name, data, err)
+		}
+	} else if r != nil && !expired {
+		err := &PanicError{
+			Vertex:      name,
+			Value:       r,
+			Stack:       debug.Stack(),
+			PayloadType: fmt.Sprintf("%T", data),
+		}
+
+		slog.LogAttrs(
+			ctx,
+			common.LevelTrace,
+			name,
+			slog.String("type", common.TraceEvent),
+			slog.Any("error", err),
+			slog.String("stack", string(err.Stack)),
+		)
 		slog.LogAttrs(
 			ctx,
 			common.LevelMetric,
 			"machine.errors",
-			slog.String("name", name),
-			slog.String("type", common.MetricInt64Counter),
-			slog.Int64("value", 1),
+			attrs.with(
+				slog.String("type", common.MetricInt64Counter),
+				slog.String("panic_type", fmt.Sprintf("%T", r)),
+				slog.String("payload_type", err.PayloadType),
+				slog.Int64("value", 1),
+			)...,
 		)
+
+		if l, ok := ctx.Value(lifecycleKey).(*lifecycle); ok {
+			l.fail(err)
+		}
+
+		if option.deadLetterFN != nil {
+			option.deadLetterFN(name, data, err)
+		}
 	}
 
 	slog.LogAttrs(
 		ctx,
 		common.LevelMetric,
 		"machine.duration",
-		slog.String("name", name),
-		slog.String("type", common.MetricInt64Histogram),
-		slog.Int64("value", duration.Milliseconds()),
+		attrs.with(
+			slog.String("type", common.MetricInt64Histogram),
+			slog.Int64("value", duration.Milliseconds()),
+		)...,
 	)
 	slog.LogAttrs(
 		ctx,
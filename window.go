@@ -0,0 +1,351 @@
+// Package machine - Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+package machine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/whitaker-io/machine/common"
+)
+
+// WindowSpec describes how payloads are assigned to windows, use TumblingWindow,
+// SlidingWindow or SessionWindow to create one.
+type WindowSpec struct {
+	kind  string
+	size  time.Duration
+	slide time.Duration
+	gap   time.Duration
+}
+
+// Pane is the aggregated value of a window for a single key, Start is inclusive and End
+// is exclusive.
+type Pane[K comparable, A any] struct {
+	Key   K
+	Start time.Time
+	End   time.Time
+	Count int
+	Value A
+}
+
+// TumblingWindow creates fixed size windows that do not overlap.
+func TumblingWindow(size time.Duration) WindowSpec {
+	return WindowSpec{kind: "tumbling", size: size, slide: size}
+}
+
+// SlidingWindow creates fixed size windows starting every slide, a payload is
+// assigned to every window it falls in.
+func SlidingWindow(size, slide time.Duration) WindowSpec {
+	return WindowSpec{kind: "sliding", size: size, slide: slide}
+}
+
+// SessionWindow creates a window per key that stays open until no payload has
+// been received for the gap.
+func SessionWindow(gap time.Duration) WindowSpec {
+	return WindowSpec{kind: "session", gap: gap}
+}
+
+// Window is a function for aggregating payloads by key into windows. Each payload is
+// folded into the Pane of every window it is assigned to using agg, starting from the zero
+// value of A, and the Pane is emitted once the window closes. Payloads are assigned by the
+// time they are received, or by their event time when m is built from EventTime. Windows
+// are opened and closed as spans through the trace level. When the context is cancelled
+// the open Panes are sent to the flush function. Like Transform it cannot be used inside
+// a loop.
+func Window[T any, K comparable, A any](
+	m Machine[T],
+	spec WindowSpec,
+	key func(d T) K,
+	agg func(acc A, d T) A,
+) (Machine[Pane[K, A]], error) {
+	x := m.(*builder[T])
+
+	if x.loop != nil {
+		return nil, fmt.Errorf("window cannot be used in a loop")
+	}
+
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	name := x.name + ":window"
+	n := x.attach("window", name, spec.describe())
+
+	this := child[T, Pane[K, A]](x, n, name, "", nil)
+
+	x.start = func(ctx context.Context, channel chan T) {
+		this.setup(ctx)
+		w := &windower[T, K, A]{
+			spec:   spec,
+			key:    key,
+			agg:    agg,
+			output: this.output,
+			panes:  map[paneID[K]]*pane[K, A]{},
+			clock:  x.clock,
+		}
+		if x.clock != nil {
+			w.wm = x.clock.watermark()
+		}
+		spawn(ctx, func() { w.run(ctx, name, channel, this.stage) })
+	}
+
+	return this, nil
+}
+
+func (s WindowSpec) validate() error {
+	switch {
+	case s.kind == "":
+		return fmt.Errorf("window spec is required")
+	case s.kind == "session" && s.gap <= 0:
+		return fmt.Errorf("session window gap must be greater than 0")
+	case s.kind != "session" && (s.size <= 0 || s.slide <= 0):
+		return fmt.Errorf("%s window size and slide must be greater than 0", s.kind)
+	}
+
+	return nil
+}
+
+func (s WindowSpec) describe() map[string]string {
+	out := map[string]string{"window": s.kind}
+
+	if s.kind == "session" {
+		out["gap"] = s.gap.String()
+	} else {
+		out["size"] = s.size.String()
+	}
+
+	if s.kind == "sliding" {
+		out["slide"] = s.slide.String()
+	}
+
+	return out
+}
+
+// starts returns the start of every window ts belongs to
+func (s WindowSpec) starts(ts time.Time) []time.Time {
+	out := []time.Time{}
+	for start := ts.Truncate(s.slide); start.After(ts.Add(-s.size)); start = start.Add(-s.slide) {
+		out = append(out, start)
+	}
+
+	return out
+}
+
+type paneID[K comparable] struct {
+	key   K
+	start int64
+}
+
+// pane holds the context of the span opened with the window
+type pane[K comparable, A any] struct {
+	Pane[K, A]
+	ctx context.Context
+}
+
+type windower[T any, K comparable, A any] struct {
+	spec   WindowSpec
+	key    func(d T) K
+	agg    func(acc A, d T) A
+	output chan Pane[K, A]
+	panes  map[paneID[K]]*pane[K, A]
+	name   string
+	attrs  labels
+	clock  *eventClock[T]
+	wm     *watermark
+}
+
+func (w *windower[T, K, A]) run(ctx context.Context, path string, input chan T, option *config) {
+	option = option.untimed()
+	name := option.vertexName(path)
+	w.name = name
+	w.attrs = option.labels(path)
+	h := vertex[T](func(_ context.Context, data T) {
+		ts := time.Now()
+		if w.clock != nil {
+			if ts = w.clock.ts(data); w.wm.observe(ts) {
+				send(ctx, w.clock.late.output, data)
+				return
+			}
+		}
+
+		w.close(w.now())
+		w.add(ctx, ts, data)
+	}).wrap(name, w.attrs, option)
+
+	d := drainFrom(ctx)
+	d.watch(func() int { return len(input) })
+	defer d.done()
+
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+
+			w.stop(option, d)
+
+			if f := flusher[T](name, option); f != nil {
+				flush(name, input, nil, f, d)
+			}
+			return
+		case <-expired:
+		case data := <-input:
+			d.add(1)
+			d.drained(name)
+			h(ctx, data)
+			d.add(-1)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		timer, expired = nil, nil
+		if next, ok := w.close(w.now()); ok && w.clock == nil {
+			timer = time.NewTimer(time.Until(next))
+			expired = timer.C
+		}
+	}
+}
+
+// now returns the watermark of the event time, or the current time if there is none
+func (w *windower[T, K, A]) now() time.Time {
+	if w.wm != nil {
+		return w.wm.now()
+	}
+
+	return time.Now()
+}
+
+// add folds the payload into the panes of the windows ts belongs to, opening them as needed
+func (w *windower[T, K, A]) add(ctx context.Context, ts time.Time, data T) {
+	k := w.key(data)
+
+	if w.spec.kind == "session" {
+		id := paneID[K]{key: k}
+		p, ok := w.panes[id]
+		if ok && !p.End.After(ts) {
+			delete(w.panes, id)
+			w.emit(p)
+			ok = false
+		}
+
+		if !ok {
+			p = w.open(ctx, k, ts, ts.Add(w.spec.gap))
+			w.panes[id] = p
+		}
+
+		if ts.Before(p.Start) {
+			p.Start = ts
+		}
+
+		if end := ts.Add(w.spec.gap); end.After(p.End) {
+			p.End = end
+		}
+
+		w.fold(p, data)
+		return
+	}
+
+	for _, start := range w.spec.starts(ts) {
+		id := paneID[K]{key: k, start: start.UnixNano()}
+		p, ok := w.panes[id]
+		if !ok {
+			p = w.open(ctx, k, start, start.Add(w.spec.size))
+			w.panes[id] = p
+		}
+
+		w.fold(p, data)
+	}
+}
+
+func (w *windower[T, K, A]) open(ctx context.Context, k K, start, end time.Time) *pane[K, A] {
+	spanHolder := map[string]any{}
+	c := common.Store(ctx, &spanHolder)
+	slog.LogAttrs(
+		c,
+		common.LevelTrace,
+		w.name,
+		w.attrs.with(
+			slog.String("type", common.TraceStart),
+			slog.Any("key", k),
+			slog.Time("window_start", start),
+		)...,
+	)
+
+	return &pane[K, A]{Pane: Pane[K, A]{Key: k, Start: start, End: end}, ctx: c}
+}
+
+func (w *windower[T, K, A]) fold(p *pane[K, A], data T) {
+	p.Value = w.agg(p.Value, data)
+	p.Count++
+}
+
+// close emits the panes that ended at or before now, in order of their end, and returns
+// the end of the next pane to close if there is one.
+func (w *windower[T, K, A]) close(now time.Time) (time.Time, bool) {
+	closed := []paneID[K]{}
+	var next time.Time
+
+	for id, p := range w.panes {
+		if !p.End.After(now) {
+			closed = append(closed, id)
+		} else if next.IsZero() || p.End.Before(next) {
+			next = p.End
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		return w.panes[closed[i]].End.Before(w.panes[closed[j]].End)
+	})
+
+	for _, id := range closed {
+		p := w.panes[id]
+		delete(w.panes, id)
+		w.emit(p)
+	}
+
+	return next, !next.IsZero()
+}
+
+func (w *windower[T, K, A]) emit(p *pane[K, A]) {
+	send(p.ctx, w.output, p.Pane)
+	w.end(p)
+}
+
+// stop sends the panes that are still open to the flush function
+func (w *windower[T, K, A]) stop(option *config, d *drain) {
+	pending := make([]Pane[K, A], 0, len(w.panes))
+	for _, p := range w.panes {
+		pending = append(pending, p.Pane)
+		w.end(p)
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].End.Before(pending[j].End)
+	})
+
+	if f := flusher[Pane[K, A]](w.name, option); f != nil {
+		flush(w.name, nil, pending, f, d)
+	}
+}
+
+func (w *windower[T, K, A]) end(p *pane[K, A]) {
+	slog.LogAttrs(
+		p.ctx,
+		common.LevelTrace,
+		w.name,
+		slog.String("type", common.TraceEnd),
+		slog.Time("window_end", p.End),
+		slog.Int("count", p.Count),
+	)
+}
@@ -0,0 +1,267 @@
+// Copyright © 2020 Jonathan Whitaker <github@whitaker.io>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package machine
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Window(b *testing.T) {
+	count := 10
+
+	for _, tc := range []struct {
+		spec  WindowSpec
+		panes int
+	}{
+		{spec: TumblingWindow(50 * time.Millisecond), panes: 1},
+		{spec: SlidingWindow(100*time.Millisecond, 50*time.Millisecond), panes: 2},
+	} {
+		spec, panes := tc.spec, tc.panes
+		channel := make(chan *kv)
+		startFn, m := New("machine_id",
+			channel,
+		)
+
+		x, err := Window(m, spec,
+			func(d *kv) string {
+				return d.name
+			},
+			func(acc int, d *kv) int {
+				return acc + d.value
+			},
+		)
+		if err != nil {
+			b.Error(err)
+			b.FailNow()
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		startFn(ctx)
+
+		for n := 0; n < count; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+
+		total, sum := 0, 0
+		for total < panes*count {
+			select {
+			case p := <-x.Output():
+				if p.Key != testPayloadBase.name || !p.End.After(p.Start) {
+					b.Errorf("unexpected pane %v", p)
+				}
+				total += p.Count
+				sum += p.Value
+			case <-time.After(time.Second):
+				b.Errorf("%s timeout waiting for panes %v", spec.kind, total)
+				b.FailNow()
+			}
+		}
+
+		if sum != panes*count*testPayloadBase.value {
+			b.Errorf("%s unexpected sum %v", spec.kind, sum)
+		}
+
+		cancel()
+	}
+}
+
+func Test_Window_Session(b *testing.T) {
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+	)
+
+	x, err := Window(m, SessionWindow(50*time.Millisecond),
+		func(d *kv) string {
+			return d.name
+		},
+		func(acc []int, d *kv) []int {
+			return append(acc, d.value)
+		},
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	if _, err := Window(m, SessionWindow(0), func(d *kv) string { return d.name }, func(acc int, d *kv) int { return acc }); err == nil {
+		b.Errorf("expected error for invalid window spec")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	for i := 0; i < 2; i++ {
+		for n := 0; n < 5; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+
+		select {
+		case p := <-x.Output():
+			if p.Count != 5 || len(p.Value) != 5 {
+				b.Errorf("unexpected session %v", p)
+			}
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for session %v", i)
+			b.FailNow()
+		}
+	}
+}
+
+func Test_Window_Flush(b *testing.T) {
+	channel := make(chan *kv)
+	flushed := &atomic.Int64{}
+	startFn, m := New("machine_id",
+		channel,
+		OptionFlush(100*time.Millisecond, func(_ string, payload any) {
+			if p, ok := payload.(Pane[string, int]); ok {
+				flushed.Add(int64(p.Count))
+			}
+		}),
+	)
+
+	x, _ := Window(m, TumblingWindow(time.Hour),
+		func(d *kv) string {
+			return d.name
+		},
+		func(acc int, d *kv) int {
+			return acc + d.value
+		},
+	)
+
+	x.Output()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	startFn(ctx)
+
+	for n := 0; n < 5; n++ {
+		channel <- deepcopy(testPayloadBase)
+	}
+
+	<-time.After(10 * time.Millisecond)
+	cancel()
+	<-time.After(50 * time.Millisecond)
+
+	if flushed.Load() != 5 {
+		b.Errorf("expected open pane to be flushed %v", flushed.Load())
+	}
+}
+
+func Test_Window_EventTime(b *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+		OptionFIF0,
+	)
+
+	onTime, late := EventTime(m, func(d *kv) time.Time {
+		return base.Add(time.Duration(d.value) * time.Second)
+	}, 2*time.Second)
+
+	x, err := Window(onTime, TumblingWindow(10*time.Second),
+		func(d *kv) string {
+			return d.name
+		},
+		func(acc []int, d *kv) []int {
+			return append(acc, d.value)
+		},
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	next := func() Pane[string, []int] {
+		select {
+		case p := <-x.Output():
+			return p
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for pane")
+			b.FailNow()
+		}
+		return Pane[string, []int]{}
+	}
+
+	for _, v := range []int{3, 1, 2, 12} {
+		channel <- &kv{name: "data0", value: v}
+	}
+
+	if p := next(); p.Count != 3 || !p.Start.Equal(base) || !p.End.Equal(base.Add(10*time.Second)) {
+		b.Errorf("unexpected pane %v", p)
+	}
+
+	channel <- &kv{name: "data0", value: 5}
+
+	select {
+	case d := <-late.Output():
+		if d.value != 5 {
+			b.Errorf("unexpected late payload %v", d)
+		}
+	case <-time.After(time.Second):
+		b.Errorf("timeout waiting for late payload")
+	}
+
+	for _, v := range []int{11, 25} {
+		channel <- &kv{name: "data0", value: v}
+	}
+
+	if p := next(); p.Count != 2 || p.Value[0] != 12 || p.Value[1] != 11 {
+		b.Errorf("unexpected pane %v", p)
+	}
+}
+
+func Test_Window_Timeout(b *testing.T) {
+	count := 100
+	channel := make(chan *kv)
+	startFn, m := New("machine_id",
+		channel,
+		OptionFIF0,
+		OptionTimeout(time.Nanosecond),
+	)
+
+	x, err := Window(m, TumblingWindow(20*time.Millisecond),
+		func(d *kv) string {
+			return d.name
+		},
+		func(acc int, d *kv) int {
+			return acc + d.value
+		},
+	)
+	if err != nil {
+		b.Error(err)
+		b.FailNow()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startFn(ctx)
+
+	go func() {
+		for n := 0; n < count; n++ {
+			channel <- deepcopy(testPayloadBase)
+		}
+	}()
+
+	total := 0
+	for total < count {
+		select {
+		case p := <-x.Output():
+			total += p.Count
+		case <-time.After(time.Second):
+			b.Errorf("timeout waiting for panes %v", total)
+			b.FailNow()
+		}
+	}
+}